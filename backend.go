@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Backend publishes the files of a build.
+type Backend interface {
+	// Store is called for each artifact as soon as it has been built into
+	// dir, it may be called concurrently.
+	Store(ctx context.Context, dir, version, filename string) error
+
+	// Publish makes the build in dir available after all artifacts have
+	// been stored and the metadata files have been written.
+	Publish(ctx context.Context, dir string, info buildInfo) error
+}
+
+// localBackend publishes builds in a directory on the local file system.
+type localBackend struct {
+	outputdir string
+
+	// dedup replaces binaries which are identical to the ones of the
+	// previous version by hardlinks.
+	dedup bool
+}
+
+func (b localBackend) Store(context.Context, string, string, string) error {
+	// the files are already in the right place
+	return nil
+}
+
+// Publish renames dir to the version directory, unless it is the version
+// directory already, and updates the "latest" symlinks.
+func (b localBackend) Publish(_ context.Context, dir string, info buildInfo) error {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	return b.publish(dir, info)
+}
+
+// publish implements Publish, the caller must hold publishMu.
+func (b localBackend) publish(dir string, info buildInfo) error {
+	versiondir := "restic-" + info.Version
+
+	if b.dedup {
+		err := b.linkIdentical(dir, versiondir, info.Artifacts)
+		if err != nil {
+			// the build is still complete without the hardlinks
+			slog.Warn("deduplicating binaries failed", "err", err)
+		}
+	}
+
+	if filepath.Clean(dir) != filepath.Join(b.outputdir, versiondir) {
+		err := publishDir(dir, filepath.Join(b.outputdir, versiondir))
+		if err != nil {
+			return err
+		}
+	}
+
+	err := updateLatest(b.outputdir, versiondir, info.Version)
+	if err != nil {
+		return fmt.Errorf("update latest failed: %w", err)
+	}
+
+	// there are no per-target symlinks on Windows
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	for _, a := range info.Artifacts {
+		// keep the extension of compressed files
+		symlink := fmt.Sprintf("latest_restic_%v_%v", a.OS, a.target().ArchName())
+		if a.Profile != "" {
+			symlink += "_" + a.Profile
+		}
+
+		symlink += info.Compress.Ext()
+
+		err = symlinkAndRename(
+			filepath.Join(versiondir, a.Filename),
+			filepath.Join(b.outputdir, symlink))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// linkIdentical replaces the artifacts in dir which are identical to the
+// ones for the same target in the latest version by hardlinks to those.
+func (b localBackend) linkIdentical(dir, versiondir string, artifacts []Artifact) error {
+	latest, err := readLatest(b.outputdir)
+	if err != nil || latest == "" {
+		return err
+	}
+
+	// when the same version is built again, e.g. because the published
+	// binaries were corrupted, they must be replaced
+	if latest == versiondir {
+		return nil
+	}
+
+	prevdir := filepath.Join(b.outputdir, latest)
+
+	prev, err := readManifest(prevdir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	previous := make(map[string]Artifact, len(prev.Artifacts))
+	for _, a := range prev.Artifacts {
+		previous[a.target().String()] = a
+	}
+
+	var saved int64
+
+	for _, a := range artifacts {
+		p, ok := previous[a.target().String()]
+		if !ok || p.SHA256 != a.SHA256 {
+			continue
+		}
+
+		// the binaries of profiles are in subdirectories
+		tmp := filepath.Join(dir, filepath.Dir(a.Filename), ".link-"+filepath.Base(a.Filename))
+		_ = os.Remove(tmp)
+
+		err = os.Link(filepath.Join(prevdir, p.Filename), tmp)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(tmp, filepath.Join(dir, a.Filename))
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+
+		saved += a.Size
+	}
+
+	if saved > 0 {
+		slog.Info("linked binaries identical to the previous version", "previous", latest, "saved", formatSize(saved))
+	}
+
+	return nil
+}
+
+// publishDir renames the directory src to dst. An existing dst, e.g. from
+// building the same version again, is replaced.
+func publishDir(src, dst string) error {
+	old := filepath.Join(filepath.Dir(dst), ".old-"+filepath.Base(dst))
+
+	err := os.RemoveAll(old)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(dst, old)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.Rename(src, dst)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(old)
+}
+
+// S3Config describes a bucket on an S3-compatible object storage.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g.
+	// https://s3.eu-central-1.amazonaws.com or the address of a MinIO
+	// server.
+	Endpoint string
+	Bucket   string
+	Region   string
+
+	// Prefix is prepended to the names of all objects.
+	Prefix string
+
+	AccessKey string
+	SecretKey string
+}
+
+// s3Backend uploads builds to an S3 bucket.
+type s3Backend struct {
+	cfg    S3Config
+	prefix string
+	client *http.Client
+}
+
+func newS3Backend(cfg S3Config, prefix string) *s3Backend {
+	return &s3Backend{
+		cfg:    cfg,
+		prefix: prefix,
+		client: &http.Client{},
+	}
+}
+
+func (b *s3Backend) key(version, filename string) string {
+	return path.Join(b.cfg.Prefix, b.prefix, "restic-"+version, filename)
+}
+
+// Store uploads the artifact.
+func (b *s3Backend) Store(ctx context.Context, dir, version, filename string) error {
+	return b.upload(ctx, b.key(version, filename), filepath.Join(dir, filename))
+}
+
+// Publish uploads the log and metadata files and then updates the object
+// "latest.txt" which contains the version.
+func (b *s3Backend) Publish(ctx context.Context, dir string, info buildInfo) error {
+	names := []string{checksumsFilename, manifestFilename}
+	if info.Signature != "" {
+		names = append(names, info.Signature)
+	}
+
+	if info.Bundle != "" {
+		names = append(names, info.Bundle)
+	}
+
+	if info.Source != nil {
+		names = append(names, info.Source.Filename)
+	}
+
+	if info.VetLog != "" {
+		names = append(names, info.VetLog)
+	}
+
+	for _, target := range info.Built {
+		names = append(names, targetLogFilename(target.String()))
+	}
+
+	for _, name := range names {
+		err := b.upload(ctx, b.key(info.Version, name), filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	latest := filepath.Join(dir, "latest.txt")
+
+	err := ioutil.WriteFile(latest, []byte(info.Version+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+
+	return b.upload(ctx, path.Join(b.cfg.Prefix, b.prefix, "latest.txt"), latest)
+}
+
+// contentType returns the MIME type for the object name.
+func contentType(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return "application/gzip"
+	case strings.HasSuffix(name, ".bz2"):
+		return "application/x-bzip2"
+	case strings.HasSuffix(name, ".json"):
+		return "application/json"
+	case strings.HasSuffix(name, ".txt"), strings.HasSuffix(name, ".log"),
+		strings.HasSuffix(name, ".asc"), strings.HasSuffix(name, ".minisig"),
+		path.Base(name) == checksumsFilename:
+		return "text/plain; charset=utf-8"
+	}
+
+	return "application/octet-stream"
+}
+
+// upload streams the file filename to the object key.
+func (b *s3Backend) upload(ctx context.Context, key, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(b.cfg.Endpoint, "/"))
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %w", err)
+	}
+
+	// use path-style addressing, it works for AWS and MinIO alike
+	u.Path = "/" + b.cfg.Bucket + "/" + key
+	u.RawPath = s3EscapePath(u.Path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), f)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", contentType(key))
+
+	// the payload is not part of the signature so that the file can be
+	// streamed instead of being read twice
+	signV4(req, b.cfg, "UNSIGNED-PAYLOAD", time.Now())
+
+	start := time.Now()
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload of %v returned %v: %s", key, res.Status, body)
+	}
+
+	slog.Debug("uploaded", "key", key, "size", fi.Size(), "duration", time.Since(start))
+
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath encodes all characters of the path p except for the unreserved
+// ones and the slash, as required for the signature.
+func s3EscapePath(p string) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			sb.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(&sb, "%%%02X", c)
+	}
+
+	return sb.String()
+}
+
+// signV4 adds the headers for AWS signature version 4 to req.
+func signV4(req *http.Request, cfg S3Config, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretKey), date)
+	key = hmacSHA256(key, cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
@@ -0,0 +1,1283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// defaultNameTemplate renders the names the binaries always had.
+const defaultNameTemplate = "restic_{{ .Version }}_{{ .OS }}_{{ .Arch }}{{ exe .OS }}"
+
+// nameData is passed to the template for the names of the binaries.
+type nameData struct {
+	Version string
+	Commit  string
+	OS      string
+	Arch    string
+	Date    time.Time
+}
+
+var nameFuncs = template.FuncMap{
+	// exe returns the extension of executables on goos
+	"exe": func(goos string) string {
+		if goos == "windows" {
+			return ".exe"
+		}
+
+		return ""
+	},
+}
+
+// parseNameTemplate parses the template for the names of the binaries.
+func parseNameTemplate(text string) (*template.Template, error) {
+	return template.New("name").Option("missingkey=error").Funcs(nameFuncs).Parse(text)
+}
+
+// targetFilenames returns the names of the binaries for the targets, without
+// the extension for the compression. Each target must get a different name.
+// The binaries for other profiles than the default one are stored in a
+// subdirectory named after the profile.
+func targetFilenames(tmpl *template.Template, targets []BuildTarget, data nameData) (map[string]string, error) {
+	names := make(map[string]string, len(targets))
+	used := make(map[string]bool, len(targets))
+
+	for _, target := range targets {
+		data.OS, data.Arch = target.OS, target.ArchName()
+
+		var buf bytes.Buffer
+
+		err := tmpl.Execute(&buf, data)
+		if err != nil {
+			return nil, fmt.Errorf("render name for %v failed: %w", target, err)
+		}
+
+		name := buf.String()
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("invalid name %q for %v", name, target)
+		}
+
+		if target.Profile != "" {
+			name = target.Profile + "/" + name
+		}
+
+		if used[name] {
+			return nil, fmt.Errorf("name %q is used for more than one target", name)
+		}
+
+		used[name] = true
+		names[target.String()] = name
+	}
+
+	return names, nil
+}
+
+// targetLogFilename returns the name of the file which receives the compiler
+// output for the target with the given name.
+func targetLogFilename(name string) string {
+	return "build_" + strings.ReplaceAll(name, "/", "_") + ".log"
+}
+
+// sha256File returns the hex-encoded SHA256 hash of the file's content.
+func sha256File(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksumsFilename is the name of the file in the version directory which
+// lists the SHA256 hashes of all artifacts, in the format used by sha256sum.
+const checksumsFilename = "SHA256SUMS"
+
+// writeChecksums writes the checksums file for artifacts to dir, in the
+// order of artifacts.
+func writeChecksums(dir string, artifacts []Artifact, source *SourceArchive) error {
+	var buf bytes.Buffer
+
+	for _, a := range artifacts {
+		fmt.Fprintf(&buf, "%v  %v\n", a.SHA256, a.Filename)
+	}
+
+	if source != nil {
+		fmt.Fprintf(&buf, "%v  %v\n", source.SHA256, source.Filename)
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, checksumsFilename), buf.Bytes(), 0644)
+}
+
+// runTests runs the test suite in repodir, it is killed after timeout.
+func runTests(ctx context.Context, repodir string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, goBinary, "test", "./...")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Dir = repodir
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("tests did not finish within %v", timeout)
+	}
+
+	return err
+}
+
+// vetLogFilename is the name of the file in the version directory which
+// contains the output of go vet.
+const vetLogFilename = "vet.log"
+
+// runVet runs go vet in repodir, it is killed after timeout. The output is
+// shown on stderr and returned.
+func runVet(ctx context.Context, repodir string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, goBinary, "vet", "./...")
+	cmd.Stdout = io.MultiWriter(os.Stderr, &out)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &out)
+	cmd.Dir = repodir
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out.String(), fmt.Errorf("go vet did not finish within %v", timeout)
+	}
+
+	return out.String(), err
+}
+
+// vetVersion runs go vet for the build in builddir and writes the output to
+// the vet log there. Findings are recorded in info, they only fail the build
+// if cfg.VetStrict is set, the log is then moved to logdir.
+func vetVersion(ctx context.Context, repodir, builddir, logdir string, cfg Config, info *buildInfo) error {
+	slog.Info("running go vet", "version", info.Version)
+
+	out, err := runVet(ctx, repodir, cfg.VetTimeout)
+
+	werr := ioutil.WriteFile(filepath.Join(builddir, vetLogFilename), []byte(out), 0644)
+	if werr != nil {
+		return fmt.Errorf("write vet log failed: %w", werr)
+	}
+
+	info.VetLog = vetLogFilename
+
+	if err == nil {
+		slog.Info("go vet passed", "version", info.Version)
+		return nil
+	}
+
+	info.VetOutput = out
+
+	if !cfg.VetStrict {
+		slog.Warn("go vet reported issues", "version", info.Version, "err", err)
+		return nil
+	}
+
+	// builddir is removed, so keep the log for inspecting the findings
+	werr = os.MkdirAll(logdir, 0755)
+	if werr == nil {
+		werr = os.Rename(filepath.Join(builddir, vetLogFilename), filepath.Join(logdir, vetLogFilename))
+	}
+
+	if werr != nil {
+		slog.Error("saving vet log failed", "err", werr)
+	}
+
+	return fmt.Errorf("go vet failed: %w", err)
+}
+
+// runHook runs the post-build hook at path for version, which was built from
+// commit. The environment variables BETA_VERSION, BETA_COMMIT, BETA_OUTPUT_DIR
+// and BETA_VERSION_DIR, the directory containing the files of the build, are
+// set for it.
+func runHook(ctx context.Context, path, version, commit, outputdir, versiondir string) error {
+	slog.Info("running post-build hook", "hook", path, "version", version)
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"BETA_VERSION="+version,
+		"BETA_COMMIT="+commit,
+		"BETA_OUTPUT_DIR="+outputdir,
+		"BETA_VERSION_DIR="+versiondir,
+	)
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("post-build hook failed: %w", err)
+	}
+
+	return nil
+}
+
+// ldflagsData is passed to the template for the linker flags.
+type ldflagsData struct {
+	Version string
+	Commit  string
+}
+
+// renderLDFlags returns the linker flags for building version at commit.
+func renderLDFlags(tmpl *template.Template, version, commit string) (string, error) {
+	if tmpl == nil {
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+
+	err := tmpl.Execute(&buf, ldflagsData{Version: version, Commit: commit})
+	if err != nil {
+		return "", fmt.Errorf("render ldflags failed: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// defaultPackage is the main package of restic.
+const defaultPackage = "./cmd/restic"
+
+// cleanPackage returns the relative path pkg of a main package in the form
+// passed to go build, e.g. "./cmd/restic". Paths outside of the repository
+// are rejected.
+func cleanPackage(pkg string) (string, error) {
+	pkg = filepath.ToSlash(pkg)
+	if !filepath.IsLocal(pkg) {
+		return "", fmt.Errorf("%q is not a relative path inside the repository", pkg)
+	}
+
+	return "./" + path.Clean(pkg), nil
+}
+
+// checkPackage returns an error if the main package pkg doesn't exist in
+// repodir, so that a changed layout of the repository is reported before
+// compiling anything.
+func checkPackage(repodir, pkg string) error {
+	dir := filepath.Join(repodir, filepath.FromSlash(pkg))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("package %v not found in %v, set the path of the main package with -package", pkg, repodir)
+	}
+
+	return nil
+}
+
+// goBuildArgs returns the arguments for "go build" which writes the binary for
+// the main package pkg to output. If strip is set, file system paths and debug
+// information are omitted from the binary, which makes it about a third
+// smaller. The extra arguments are added last, so they take precedence, e.g.
+// passing -ldflags replaces the linker flags.
+func goBuildArgs(pkg, output, ldflags string, strip bool, extra []string) []string {
+	args := []string{"build", "-o", output}
+
+	if strip {
+		args = append(args, "-trimpath")
+		ldflags = strings.TrimSpace("-s -w " + ldflags)
+	}
+
+	if ldflags != "" {
+		args = append(args, "-ldflags", ldflags)
+	}
+
+	args = append(args, extra...)
+
+	return append(args, pkg)
+}
+
+// splitArgs splits s into arguments at white space. Single or double quotes
+// group arguments containing white space, there is no shell involved.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, c := range s {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c in %q", quote, s)
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
+
+// checkBuildArgs rejects arguments for go build which would change where
+// the binary is written.
+func checkBuildArgs(args []string) error {
+	for _, arg := range args {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && (name == "o" || name == "C") {
+			return fmt.Errorf("argument %q is not allowed, the builder sets the output path", arg)
+		}
+	}
+
+	return nil
+}
+
+// job holds everything needed to build a target of a version. It is sent to
+// remote workers as JSON.
+type job struct {
+	Commit   string      `json:"commit"`
+	Version  string      `json:"version"`
+	Dir      string      `json:"dir"`
+	LDFlags  string      `json:"ldflags"`
+	Strip    bool        `json:"strip"`
+	Compress Compression `json:"compress"`
+	Target   BuildTarget `json:"target"`
+
+	// GoVersion is the output of "go version" for the go command which
+	// compiles the target, it is recorded in the provenance.
+	GoVersion string `json:"go_version"`
+
+	// Package is the path of the main package relative to the repository,
+	// empty selects defaultPackage.
+	Package string `json:"package,omitempty"`
+
+	// Filenames maps the names of the targets to the names of the
+	// binaries, without the extension for the compression.
+	Filenames map[string]string `json:"filenames"`
+
+	// BuildArgs are passed to go build in addition to the flags set by
+	// the builder.
+	BuildArgs []string `json:"build_args"`
+
+	// Timeout limits the time for compiling the target, zero means no
+	// limit.
+	Timeout time.Duration `json:"timeout"`
+
+	// Reproducible sets up the environment so that the binary only
+	// depends on the source code and the Go version. If Verify is also
+	// set, the target is compiled a second time without using the build
+	// cache and the results are compared.
+	Reproducible bool `json:"reproducible"`
+	Verify       bool `json:"verify"`
+
+	// VerifyBinary runs each binary built for the host with "version"
+	// and fails the target if that doesn't work. Binaries for the targets
+	// in Emulators are run with the command line given there, e.g.
+	// "qemu-aarch64", all others are not checked.
+	VerifyBinary bool              `json:"verify_binary"`
+	Emulators    map[string]string `json:"emulators"`
+
+	// CGO lists the targets which are compiled with cgo enabled, for all
+	// others it is disabled.
+	CGO map[string]bool `json:"cgo"`
+
+	// Profiles maps the names of the profiles other than the default one
+	// to their settings.
+	Profiles map[string]BuildProfile `json:"profiles,omitempty"`
+
+	// UPX packs the binaries with UPX before they are verified.
+	UPX bool `json:"upx,omitempty"`
+
+	// Notary, if set, signs and notarizes the macOS binaries.
+	Notary *Notary `json:"notary,omitempty"`
+}
+
+// reproducibleGoFlags removes the local file system paths and the state of
+// the working tree from the binaries.
+const reproducibleGoFlags = "-trimpath -buildvcs=false -mod=readonly"
+
+// buildEnv returns the environment for compiling j.
+func buildEnv(j job) []string {
+	env := os.Environ()
+
+	if j.Reproducible {
+		env = append(env, "GOFLAGS="+reproducibleGoFlags)
+	}
+
+	// the environment of the target comes last, so it takes precedence
+	return append(env, j.Target.env(j.CGO[j.Target.base().String()])...)
+}
+
+// provenanceVars lists the environment variables recorded in the provenance of
+// the binaries in addition to those set for the target.
+var provenanceVars = []string{
+	"GOOS", "GOARCH", "GOARM", "GOAMD64", "GO386", "GOMIPS", "GOPPC64",
+	"CGO_ENABLED", "GOFLAGS", "GOEXPERIMENT", "GOTOOLCHAIN", "CC",
+}
+
+// newBuildProvenance returns the provenance of the binary built for j into
+// the file filename relative to j.Dir by the go command invoked with args in
+// the environment env.
+func newBuildProvenance(j job, filename string, args, env []string) *BuildProvenance {
+	p := &BuildProvenance{Env: make(map[string]string)}
+
+	// the output is a local path, record the name in the version directory
+	p.Args = append([]string(nil), args...)
+	for i := range p.Args {
+		if i > 0 && p.Args[i-1] == "-o" {
+			p.Args[i] = filename
+		}
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range provenanceVars {
+		wanted[name] = true
+	}
+
+	for name := range j.Target.Env {
+		wanted[name] = true
+	}
+
+	// later values override earlier ones, like for the go command
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		if wanted[name] {
+			p.Env[name] = value
+		}
+	}
+
+	p.GoVersion = j.GoVersion
+
+	return p
+}
+
+// verifyReproducible compiles j again, ignoring the build cache, and checks
+// that the result is identical to the binary in filename.
+func verifyReproducible(ctx context.Context, repodir string, j job, filename string) error {
+	dir, err := ioutil.TempDir("", "beta-verify-")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, filepath.Base(filename))
+
+	// -a rebuilds all packages instead of using the cached results
+	cmd := exec.CommandContext(ctx, goBinary, j.buildArgs(output, "-a")...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = repodir
+	cmd.Env = buildEnv(j)
+
+	err = runCompile(cmd)
+	if err != nil {
+		return fmt.Errorf("second build failed: %w", err)
+	}
+
+	want, err := sha256File(filename)
+	if err != nil {
+		return err
+	}
+
+	got, err := sha256File(output)
+	if err != nil {
+		return err
+	}
+
+	if got != want {
+		return fmt.Errorf("second build has hash %v instead of %v", got, want)
+	}
+
+	return nil
+}
+
+// verifyBinaryTimeout limits the time a binary may take to print its version.
+const verifyBinaryTimeout = time.Minute
+
+// verifyBinary runs the binary in filename with "version", prefixed by the
+// emulator command line if it is not empty. It fails if the binary doesn't
+// exit successfully or doesn't print the version, which is only expected if
+// it is passed in the linker flags.
+func verifyBinary(ctx context.Context, j job, filename, emulator string) error {
+	ctx, cancel := context.WithTimeout(ctx, verifyBinaryTimeout)
+	defer cancel()
+
+	args := append(strings.Fields(emulator), filename, "version")
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = filepath.Dir(filename)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("running %v version failed: %w, output: %q", filepath.Base(filename), err, out)
+	}
+
+	if strings.Contains(j.LDFlags, j.Version) && !strings.Contains(string(out), j.Version) {
+		return fmt.Errorf("%v version printed %q, which does not contain %v", filepath.Base(filename), out, j.Version)
+	}
+
+	return nil
+}
+
+// buildTarget compiles the version checked out in repodir for j.Target and
+// writes the (compressed) binary to j.Dir.
+func buildTarget(ctx context.Context, repodir string, j job) (Artifact, error) {
+	target := j.Target
+	filename := j.Filenames[target.String()]
+	artifact := filename + j.Compress.Ext()
+	start := time.Now()
+
+	slog.Debug("build target", "version", j.Version, "os", target.OS, "arch", target.ArchName())
+
+	// each target has its own log file, so concurrent builds don't mix
+	// their output
+	logfile, err := os.Create(filepath.Join(j.Dir, targetLogFilename(target.String())))
+	if err != nil {
+		return Artifact{}, BuildError{Target: target, Err: fmt.Errorf("create log file failed: %w", err)}
+	}
+
+	defer logfile.Close()
+
+	buildCtx := ctx
+	if j.Timeout > 0 {
+		var cancel context.CancelFunc
+		buildCtx, cancel = context.WithTimeout(ctx, j.Timeout)
+		defer cancel()
+	}
+
+	// the binaries of other profiles than the default go to subdirectories
+	err = os.MkdirAll(filepath.Dir(filepath.Join(j.Dir, filename)), 0755)
+	if err != nil {
+		return Artifact{}, BuildError{Target: target, Err: err}
+	}
+
+	args := j.buildArgs(filepath.Join(j.Dir, filename))
+	env := buildEnv(j)
+
+	cmd := exec.CommandContext(buildCtx, goBinary, args...)
+	cmd.Stdout = io.MultiWriter(os.Stdout, logfile)
+	cmd.Stderr = io.MultiWriter(os.Stderr, logfile)
+	cmd.Dir = repodir
+	cmd.Env = env
+
+	// the compiler processes started by go may keep the output pipes open
+	// after go has been killed, don't wait for them forever
+	cmd.WaitDelay = 10 * time.Second
+
+	err = runCompile(cmd)
+	if ctx.Err() != nil {
+		// don't leave a truncated binary behind
+		_ = os.Remove(filepath.Join(j.Dir, filename))
+		return Artifact{}, BuildError{Target: target, Err: fmt.Errorf("compiling for %v aborted: %w", target, ctx.Err())}
+	}
+
+	if buildCtx.Err() == context.DeadlineExceeded {
+		_ = os.Remove(filepath.Join(j.Dir, filename))
+		slog.Error("compiling timed out", "version", j.Version, "os", target.OS, "arch", target.ArchName(), "timeout", j.Timeout)
+		return Artifact{}, BuildError{Target: target, Err: fmt.Errorf("compiling for %v timed out after %v", target, j.Timeout)}
+	}
+
+	if err != nil {
+		slog.Error("compiling failed", "version", j.Version, "os", target.OS, "arch", target.ArchName(), "err", err)
+		return Artifact{}, BuildError{Target: target, Err: fmt.Errorf("compiling for %v failed: %w", target, err)}
+	}
+
+	if j.Verify {
+		err = verifyReproducible(ctx, repodir, j, filepath.Join(j.Dir, filename))
+		if err != nil {
+			slog.Warn("build is not reproducible", "version", j.Version, "os", target.OS, "arch", target.ArchName(), "err", err)
+		} else {
+			slog.Debug("build is reproducible", "version", j.Version, "os", target.OS, "arch", target.ArchName())
+		}
+	}
+
+	// the packed binary is the one which is verified and published
+	if j.UPX {
+		packBinary(ctx, target, filepath.Join(j.Dir, filename))
+	}
+
+	if j.Notary != nil {
+		notarizeBinary(ctx, *j.Notary, target, filepath.Join(j.Dir, filename))
+	}
+
+	emulator, ok := j.Emulators[target.base().String()]
+	native := target.OS == runtime.GOOS && target.Arch == runtime.GOARCH
+
+	if j.VerifyBinary && (native || ok) {
+		err = verifyBinary(ctx, j, filepath.Join(j.Dir, filename), emulator)
+		if err != nil {
+			slog.Error("binary is broken", "version", j.Version, "os", target.OS, "arch", target.ArchName(), "err", err)
+			_ = os.Remove(filepath.Join(j.Dir, filename))
+
+			return Artifact{}, BuildError{Target: target, Err: fmt.Errorf("verifying binary for %v failed: %w", target, err)}
+		}
+
+		slog.Debug("binary works", "version", j.Version, "os", target.OS, "arch", target.ArchName())
+	}
+
+	bin, err := os.Stat(filepath.Join(j.Dir, filename))
+	if err != nil {
+		return Artifact{}, BuildError{Target: target, Err: err}
+	}
+
+	err = compressFile(j.Compress, filepath.Join(j.Dir, filename))
+	if err != nil {
+		return Artifact{}, BuildError{Target: target, Err: fmt.Errorf("compressing %v failed: %w", filename, err)}
+	}
+
+	hash, err := sha256File(filepath.Join(j.Dir, artifact))
+	if err != nil {
+		return Artifact{}, BuildError{Target: target, Err: fmt.Errorf("checksum for %v failed: %w", artifact, err)}
+	}
+
+	fi, err := os.Stat(filepath.Join(j.Dir, artifact))
+	if err != nil {
+		return Artifact{}, BuildError{Target: target, Err: err}
+	}
+
+	targetDuration.WithLabelValues(target.OS, target.ArchName()).Observe(time.Since(start).Seconds())
+
+	slog.Info("built target", "version", j.Version, "os", target.OS, "arch", target.ArchName(),
+		"duration", time.Since(start), "size", fi.Size(), "stripped", j.Strip)
+
+	return Artifact{
+		OS:         target.OS,
+		Arch:       target.Arch,
+		Variant:    target.Variant,
+		Profile:    target.Profile,
+		Filename:   artifact,
+		Size:       fi.Size(),
+		SHA256:     hash,
+		BinarySize: bin.Size(),
+		Build:      newBuildProvenance(j, filename, args, env),
+	}, nil
+}
+
+// buildInfo describes the outcome of a build.
+type buildInfo struct {
+	Version  string
+	Duration time.Duration
+
+	// Files lists the names of the published files in the version
+	// directory.
+	Files []string
+
+	// Artifacts describes the files built for the targets, which are
+	// compressed with Compress.
+	Artifacts []Artifact
+	Compress  Compression
+
+	// Signature is the name of the signature of the checksums file, it is
+	// empty if signing is disabled.
+	Signature string
+
+	// Bundle is the name of the archive containing all files of the build,
+	// it is empty if no bundle was requested.
+	Bundle string
+
+	// Source describes the archive of the source code, it is nil if none
+	// was requested.
+	Source *SourceArchive
+
+	// Built lists the targets which were built successfully, Failed maps
+	// the names of failed targets to the error.
+	Built  []BuildTarget
+	Failed map[string]error
+
+	// Durations maps the names of the targets to the time it took to
+	// build them, including failed ones.
+	Durations map[string]time.Duration
+
+	// Sizes compares the sizes of the binaries built successfully to the
+	// previous version in the output directory.
+	Sizes map[string]sizeChange
+
+	// VetLog is the name of the file containing the output of go vet, it
+	// is empty if go vet wasn't run. VetOutput is the output if go vet
+	// reported issues.
+	VetLog    string
+	VetOutput string
+
+	// Changes lists the commits since the previous tag, see
+	// Config.Changes.
+	Changes *Changes
+}
+
+// build compiles the version checked out in repodir for all targets and
+// publishes them via backend. The files are collected in a subdirectory of
+// outputdir first. When ctx is canceled, no further targets are started and
+// running compilations are aborted.
+func build(ctx context.Context, repodir, outputdir, version string, backend Backend, cfg Config) (buildInfo, error) {
+	start := time.Now()
+	info := buildInfo{
+		Version:   version,
+		Compress:  cfg.Compress,
+		Failed:    make(map[string]error),
+		Durations: make(map[string]time.Duration),
+		Changes:   cfg.Changes,
+	}
+	versiondir := fmt.Sprintf("restic-%v", version)
+
+	// everything is written to builddir first, which is only published once
+	// all targets have been built successfully. Incremental builds are
+	// written to the version directory right away.
+	builddir := filepath.Join(outputdir, ".tmp-"+versiondir)
+	if cfg.Incremental {
+		builddir = filepath.Join(outputdir, versiondir)
+	}
+
+	// a full disk would make the build fail halfway
+	err := checkFreeSpace(outputdir, cfg)
+	if err != nil {
+		return info, err
+	}
+
+	err = checkPackage(repodir, cfg.Package)
+	if err != nil {
+		return info, err
+	}
+
+	previous := previousSizes(outputdir)
+
+	if cfg.RunTests {
+		slog.Info("running tests", "version", version)
+
+		err := runTests(ctx, repodir, cfg.TestTimeout)
+		if err != nil {
+			return info, fmt.Errorf("tests failed: %w", err)
+		}
+
+		slog.Info("tests passed", "version", version, "duration", time.Since(start))
+	}
+
+	slog.Info("compiling", "version", version)
+
+	if cfg.ProfileResources {
+		stop := profileResources(version)
+		defer stop()
+	}
+
+	commit, err := commitID(ctx, repodir, "HEAD")
+	if err != nil {
+		return info, err
+	}
+
+	goVer, err := goVersion()
+	if err != nil {
+		return info, err
+	}
+
+	ldflags, err := renderLDFlags(cfg.LDFlags, version, commit)
+	if err != nil {
+		return info, err
+	}
+
+	filenames, err := targetFilenames(cfg.Name, cfg.Targets, nameData{Version: version, Commit: commit, Date: start})
+	if err != nil {
+		return info, err
+	}
+
+	// the targets built successfully by an earlier build of the same
+	// commit which failed or was interrupted are reused
+	done := buildResults{
+		Commit:   commit,
+		Settings: buildSettings(cfg, ldflags, goVer),
+		Targets:  make(map[string]cachedResult),
+	}
+
+	if !cfg.Incremental {
+		removeStaleBuilds(outputdir, builddir)
+
+		if !cfg.Rebuild {
+			done.Targets = loadResults(builddir, commit, done.Settings, filenames)
+		}
+	}
+
+	var reuse []buildResult
+	var todo []BuildTarget
+
+	for _, target := range cfg.Targets {
+		r, ok := done.Targets[target.String()]
+		if !ok {
+			todo = append(todo, target)
+			continue
+		}
+
+		reuse = append(reuse, buildResult{Target: target, Artifact: r.Artifact, Duration: r.Duration})
+	}
+
+	if len(reuse) == 0 {
+		done.Targets = make(map[string]cachedResult)
+
+		// remove leftovers from an interrupted earlier build
+		err = os.RemoveAll(builddir)
+		if err != nil {
+			return info, fmt.Errorf("remove old build dir failed: %w", err)
+		}
+	}
+
+	err = os.MkdirAll(builddir, 0755)
+	if err != nil {
+		return info, fmt.Errorf("mkdir output dir failed: %w", err)
+	}
+
+	// builddir is gone after a successful publish, otherwise it contains
+	// an incomplete build which is kept for reusing the targets built
+	// successfully. An incremental build keeps the targets which have
+	// been published already.
+	published := false
+
+	if !cfg.Incremental {
+		defer func() {
+			if published {
+				_ = os.RemoveAll(builddir)
+			}
+		}()
+	}
+
+	if cfg.Vet {
+		err = vetVersion(ctx, repodir, builddir, failureLogDir(outputdir, version, cfg.Incremental), cfg, &info)
+		if err != nil {
+			return info, err
+		}
+	}
+
+	// results are collected in a single goroutine, which fills in info
+	results := make(chan buildResult)
+	collected := make(chan []buildResult)
+	progress := interactive()
+
+	var errs []error
+
+	go func() {
+		var all []buildResult
+
+		for res := range results {
+			err := res.Err
+
+			all = append(all, res)
+			info.Durations[res.Target.String()] = res.Duration
+
+			if err != nil {
+				errs = append(errs, err)
+				info.Failed[res.Target.String()] = err
+			} else {
+				info.Built = append(info.Built, res.Target)
+				info.Artifacts = append(info.Artifacts, res.Artifact)
+			}
+
+			if !cfg.Incremental && err == nil {
+				done.Targets[res.Target.String()] = cachedResult{Artifact: res.Artifact, Duration: res.Duration}
+
+				saveErr := saveResults(builddir, done)
+				if saveErr != nil {
+					slog.Warn("write results file failed", "err", saveErr)
+				}
+			}
+
+			if cfg.Incremental && err == nil {
+				sortArtifacts(info.Artifacts)
+				publishPartial(outputdir, builddir, cfg, Manifest{
+					Commit:    commit,
+					Version:   version,
+					GoVersion: goVer,
+					BuildTime: start,
+					Artifacts: info.Artifacts,
+				})
+			}
+
+			if progress {
+				printProgress(os.Stderr, len(all), len(cfg.Targets))
+			}
+		}
+
+		collected <- all
+	}()
+
+	// closeMu protects closed, results reported by remote workers may still
+	// come in after an aborted build has finished
+	var closeMu sync.Mutex
+	var closed bool
+
+	// the artifacts are stored in the background, so that the workers
+	// can compile the next targets while at most cfg.Uploads are stored
+	uploads := make(chan struct{}, cfg.Uploads)
+	var stored sync.WaitGroup
+
+	record := func(res buildResult) {
+		closeMu.Lock()
+		defer closeMu.Unlock()
+
+		if closed {
+			return
+		}
+
+		stored.Add(1)
+
+		go func() {
+			defer stored.Done()
+
+			if res.Err == nil {
+				uploads <- struct{}{}
+				err := backend.Store(ctx, builddir, version, res.Artifact.Filename)
+				<-uploads
+
+				if err != nil {
+					res.Err = PublishError{Version: version, Err: fmt.Errorf("storing %v failed: %w", res.Artifact.Filename, err)}
+				}
+			}
+
+			if res.Err != nil {
+				cfg.Progress.set(res.Target, targetFailed)
+			} else {
+				cfg.Progress.set(res.Target, targetDone)
+			}
+
+			results <- res
+		}()
+	}
+
+	if cfg.WindowsResources != nil {
+		cleanup, err := writeWindowsResources(ctx, repodir, cfg.Package, *cfg.WindowsResources, version, todo, filenames)
+		if err != nil {
+			return info, err
+		}
+
+		defer cleanup()
+	}
+
+	batch := job{
+		Commit:       commit,
+		Version:      version,
+		GoVersion:    goVer,
+		Dir:          builddir,
+		LDFlags:      ldflags,
+		Strip:        cfg.Strip,
+		Compress:     cfg.Compress,
+		Package:      cfg.Package,
+		Filenames:    filenames,
+		Timeout:      cfg.BuildTimeout,
+		BuildArgs:    cfg.BuildArgs,
+		Reproducible: cfg.Reproducible,
+		Verify:       cfg.VerifyReproducible,
+		VerifyBinary: cfg.VerifyBinaries,
+		Emulators:    cfg.Emulators,
+		CGO:          cfg.CGO,
+		Profiles:     cfg.Profiles,
+		UPX:          cfg.UPX,
+		Notary:       cfg.Notary,
+	}
+
+	for _, res := range reuse {
+		slog.Info("reusing target built earlier", "version", version, "target", res.Target)
+		record(res)
+	}
+
+	var disp Dispatcher
+
+	if cfg.Queue != nil {
+		// remote workers can take targets from the queue, the local
+		// workers help out
+		cfg.Queue.start(batch, todo, record)
+
+		// an aborted build also stops handing out targets
+		stopQueue := context.AfterFunc(ctx, cfg.Queue.stop)
+		defer func() {
+			stopQueue()
+			cfg.Queue.stop()
+		}()
+
+		disp = cfg.Queue
+	} else {
+		ch := make(chan BuildTarget)
+		disp = &chanDispatcher{ch: ch, report: record}
+
+		go func() {
+			defer close(ch)
+
+			for _, target := range todo {
+				select {
+				case ch <- target:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < cfg.Jobs; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				target, ok := disp.Next()
+				if !ok {
+					return
+				}
+
+				j := batch
+				j.Target = target
+
+				cfg.Progress.set(target, targetBuilding)
+
+				start := time.Now()
+				artifact, err := buildTarget(ctx, repodir, j)
+
+				disp.Report(buildResult{
+					Target:   target,
+					Artifact: artifact,
+					Duration: time.Since(start),
+					Err:      err,
+				})
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	closeMu.Lock()
+	closed = true
+	closeMu.Unlock()
+
+	stored.Wait()
+	close(results)
+
+	all := <-collected
+	compareSizes(&info, previous, cfg.MaxGrowth)
+	printSummary(os.Stdout, cfg.Targets, all, info.Sizes)
+
+	if ctx.Err() != nil {
+		return info, fmt.Errorf("build aborted: %w", ctx.Err())
+	}
+
+	// the order in which the targets finish varies, so the checksums and
+	// the manifest are sorted to be comparable across builds
+	sortArtifacts(info.Artifacts)
+
+	if cfg.Source && len(errs) == 0 {
+		// the commit is the one the binaries were built from, even if
+		// the branch has moved on in the meantime
+		source, err := writeSourceArchive(ctx, repodir, builddir, version, commit)
+		if err != nil {
+			return info, fmt.Errorf("creating source archive failed: %w", err)
+		}
+
+		info.Source = &source
+		info.Files = append(info.Files, source.Filename)
+	}
+
+	err = writeChecksums(builddir, info.Artifacts, info.Source)
+	if err != nil {
+		return info, fmt.Errorf("write checksums file failed: %w", err)
+	}
+
+	info.Duration = time.Since(start)
+
+	for _, a := range info.Artifacts {
+		info.Files = append(info.Files, a.Filename, targetLogFilename(a.target().String()))
+	}
+
+	info.Files = append(info.Files, checksumsFilename, manifestFilename)
+	if info.VetLog != "" {
+		info.Files = append(info.Files, info.VetLog)
+	}
+
+	if len(errs) > 0 {
+		// builddir is removed, so keep the logs for inspecting the
+		// failure, incremental builds write them to the version directory
+		if !cfg.Incremental {
+			logdir := failureLogDir(outputdir, version, false)
+
+			err := saveLogs(builddir, logdir, cfg.Targets)
+			if err != nil {
+				slog.Error("saving build logs failed", "err", err)
+			} else {
+				slog.Info("saved build logs", "dir", logdir)
+			}
+		}
+
+		return info, fmt.Errorf("not publishing incomplete build: %w", errors.Join(errs...))
+	}
+
+	if cfg.Sign != nil {
+		info.Signature, err = sign(ctx, *cfg.Sign, builddir, checksumsFilename)
+		if err != nil {
+			return info, err
+		}
+
+		info.Files = append(info.Files, info.Signature)
+	}
+
+	err = writeManifest(builddir, Manifest{
+		Commit:    commit,
+		Version:   version,
+		GoVersion: goVer,
+		BuildTime: start,
+		Artifacts: info.Artifacts,
+		Compress:  cfg.Compress,
+		Changes:   cfg.Changes,
+		Source:    info.Source,
+	})
+	if err != nil {
+		return info, fmt.Errorf("write manifest failed: %w", err)
+	}
+
+	if cfg.Bundle {
+		files := []string{checksumsFilename, manifestFilename}
+		if info.Signature != "" {
+			files = append(files, info.Signature)
+		}
+
+		for _, a := range info.Artifacts {
+			files = append(files, a.Filename)
+		}
+
+		err = writeBundle(builddir, version, files)
+		if err != nil {
+			return info, err
+		}
+
+		info.Bundle = bundleFilename(version)
+		info.Files = append(info.Files, info.Bundle)
+	}
+
+	slog.Info("built version", "version", version, "duration", info.Duration)
+
+	_ = os.Remove(filepath.Join(builddir, resultsFilename))
+
+	err = backend.Publish(ctx, builddir, info)
+	if err != nil {
+		return info, PublishError{Version: version, Err: err}
+	}
+
+	published = true
+
+	if cfg.PostBuildHook != "" {
+		// with S3, the files are only uploaded and not moved
+		dir := filepath.Join(outputdir, versiondir)
+		if cfg.S3 != nil {
+			dir = builddir
+		}
+
+		err = runHook(ctx, cfg.PostBuildHook, version, commit, outputdir, dir)
+		if err != nil && cfg.PostBuildHookFatal {
+			return info, err
+		}
+
+		if err != nil {
+			slog.Warn("ignoring failed post-build hook", "err", err)
+		}
+	}
+
+	return info, nil
+}
+
+// publishPartial writes the checksums file and the manifest listing the
+// targets of an incremental build which are done so far to dir and updates
+// the index in outputdir, so that the binaries can be downloaded before all
+// targets are built. Failures are only logged.
+func publishPartial(outputdir, dir string, cfg Config, m Manifest) {
+	err := writeChecksums(dir, m.Artifacts, nil)
+	if err != nil {
+		slog.Warn("write partial checksums file failed", "err", err)
+		return
+	}
+
+	err = writeManifest(dir, m)
+	if err != nil {
+		slog.Warn("write partial manifest failed", "err", err)
+		return
+	}
+
+	err = writeIndex(outputdir, cfg.Index)
+	if err != nil {
+		slog.Warn("writing index failed", "err", err)
+	}
+}
+
+// failedDirname is the directory in the output directory which keeps the logs
+// of failed builds, so that they aren't mistaken for published versions.
+const failedDirname = ".failed"
+
+// failureLogDir returns the directory in outputdir the logs of a failed build
+// of version are kept in. Incremental builds write them to the version
+// directory.
+func failureLogDir(outputdir, version string, incremental bool) string {
+	if incremental {
+		return filepath.Join(outputdir, "restic-"+version)
+	}
+
+	return filepath.Join(outputdir, failedDirname, "restic-"+version)
+}
+
+// saveLogs copies the log files of targets from dir to logdir, dir is kept
+// for reusing the targets built successfully.
+func saveLogs(dir, logdir string, targets []BuildTarget) error {
+	err := os.MkdirAll(logdir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range targets {
+		name := targetLogFilename(target.String())
+
+		buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(filepath.Join(logdir, name), buf, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
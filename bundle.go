@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// bundleFilename returns the name of the archive containing all files of
+// version.
+func bundleFilename(version string) string {
+	return fmt.Sprintf("restic-%v.tar.gz", version)
+}
+
+// writeBundle creates the bundle for version in dir containing the files
+// from dir in a directory named after the version. The archive is streamed
+// to the file, so the files are never held in memory.
+func writeBundle(dir, version string, files []string) (err error) {
+	filename := filepath.Join(dir, bundleFilename(version))
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("create bundle failed: %w", err)
+	}
+
+	defer func() {
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+
+		if err != nil {
+			_ = os.Remove(filename)
+		}
+	}()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	for _, name := range files {
+		err = addToBundle(tw, filepath.Join(dir, name), fmt.Sprintf("restic-%v/%v", version, name))
+		if err != nil {
+			return fmt.Errorf("adding %v to bundle failed: %w", name, err)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+func addToBundle(tw *tar.Writer, filename, name string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = name
+
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// setupGoCache makes all go commands started by this process use the build
+// cache in gocache and the module cache in gomodcache. An empty directory
+// keeps the default of the go command.
+func setupGoCache(gocache, gomodcache string) error {
+	for _, v := range []struct{ name, dir string }{
+		{"GOCACHE", gocache},
+		{"GOMODCACHE", gomodcache},
+	} {
+		if v.dir == "" {
+			continue
+		}
+
+		// the go command only accepts absolute paths
+		dir, err := filepath.Abs(v.dir)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("create %v failed: %w", v.name, err)
+		}
+
+		// the environment is inherited by the compiler processes
+		err = os.Setenv(v.name, dir)
+		if err != nil {
+			return err
+		}
+
+		slog.Debug("using cache", "var", v.name, "dir", dir)
+	}
+
+	return nil
+}
+
+// warmCache downloads the modules needed by the code in repodir and compiles
+// all packages for each target, so that the first build only needs to
+// compile what has changed since. Strip and cgo must match the settings for
+// the builds, otherwise the cached results cannot be reused.
+func warmCache(ctx context.Context, repodir string, targets []BuildTarget, strip bool, cgo map[string]bool) error {
+	start := time.Now()
+
+	cmd := exec.CommandContext(ctx, goBinary, "mod", "download")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = repodir
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("go mod download failed: %w", err)
+	}
+
+	args := []string{"build"}
+	if strip {
+		args = append(args, "-trimpath")
+	}
+
+	args = append(args, "./...")
+
+	for _, target := range targets {
+		// the profiles only differ in the flags
+		if target.Profile != "" {
+			continue
+		}
+
+		cmd := exec.CommandContext(ctx, goBinary, args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Dir = repodir
+		cmd.Env = append(os.Environ(), target.env(cgo[target.base().String()])...)
+
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("compiling for %v failed: %w", target, err)
+		}
+	}
+
+	slog.Info("warmed build cache", "duration", time.Since(start))
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Types of webhooks, which differ in the JSON document sent.
+const (
+	webhookGeneric = "generic"
+	webhookSlack   = "slack"
+	webhookDiscord = "discord"
+)
+
+// Colors of the messages sent to Slack and Discord.
+const (
+	colorSuccess = 0x2eb886
+	colorFailure = 0xd40e0d
+)
+
+// chatMessage contains the text of a notification for a chat service.
+type chatMessage struct {
+	Title string
+	Link  string
+	Text  string
+	Color int
+
+	// Fields lists pairs of names and values, values are never empty.
+	Fields [][2]string
+}
+
+func newChatMessage(p webhookPayload) chatMessage {
+	msg := chatMessage{
+		Title: buildName(p.Repo, p.Branch) + " build fixed: " + p.Version,
+		Link:  p.CommitURL,
+		Color: colorSuccess,
+	}
+
+	switch p.Status {
+	case "success":
+	case "corrupt":
+		msg.Title = buildName(p.Repo, p.Branch) + " published build corrupted: " + p.Version
+		msg.Text = p.Error + ": " + strings.Join(p.Files, ", ")
+		msg.Color = colorFailure
+	default:
+		msg.Title = buildName(p.Repo, p.Branch) + " build failed: " + p.Version
+		msg.Text = p.Error
+		msg.Color = colorFailure
+	}
+
+	commit := p.Commit
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+
+	if p.Version != "" {
+		msg.Fields = append(msg.Fields, [2]string{"Version", p.Version})
+	}
+
+	msg.Fields = append(msg.Fields, [2]string{"Commit", commit})
+
+	if p.Changes != nil {
+		msg.Fields = append(msg.Fields, [2]string{"Changes since " + p.Changes.Since, changesSummary(p.Changes)})
+	}
+
+	if p.Stage != "" {
+		msg.Fields = append(msg.Fields, [2]string{"Failed in", p.Stage})
+	}
+
+	if len(p.Failed) > 0 {
+		msg.Fields = append(msg.Fields, [2]string{"Failed targets", strings.Join(p.Failed, ", ")})
+	}
+
+	if p.Vet != "" {
+		msg.Fields = append(msg.Fields, [2]string{"go vet", "reported issues, see " + vetLogFilename})
+	}
+
+	return msg
+}
+
+// changesSummary returns the number of commits in c.
+func changesSummary(c *Changes) string {
+	s := fmt.Sprintf("%d commits", len(c.Commits))
+	if len(c.Commits) == 1 {
+		s = "1 commit"
+	}
+
+	if c.Truncated {
+		s = "more than " + s
+	}
+
+	return s
+}
+
+// slackBody returns the document for a Slack incoming webhook.
+func slackBody(msg chatMessage) any {
+	type field struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+		Short bool   `json:"short"`
+	}
+
+	type attachment struct {
+		Fallback  string  `json:"fallback"`
+		Color     string  `json:"color"`
+		Title     string  `json:"title"`
+		TitleLink string  `json:"title_link,omitempty"`
+		Text      string  `json:"text,omitempty"`
+		Fields    []field `json:"fields"`
+	}
+
+	a := attachment{
+		Fallback:  msg.Title,
+		Color:     fmt.Sprintf("#%06x", msg.Color),
+		Title:     msg.Title,
+		TitleLink: msg.Link,
+		Text:      msg.Text,
+	}
+
+	for _, f := range msg.Fields {
+		a.Fields = append(a.Fields, field{Title: f[0], Value: f[1], Short: f[0] != "Failed targets"})
+	}
+
+	return struct {
+		Attachments []attachment `json:"attachments"`
+	}{[]attachment{a}}
+}
+
+// discordBody returns the document for a Discord webhook.
+func discordBody(msg chatMessage) any {
+	type field struct {
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		Inline bool   `json:"inline"`
+	}
+
+	type embed struct {
+		Title       string  `json:"title"`
+		URL         string  `json:"url,omitempty"`
+		Description string  `json:"description,omitempty"`
+		Color       int     `json:"color"`
+		Fields      []field `json:"fields"`
+	}
+
+	e := embed{
+		Title:       msg.Title,
+		URL:         msg.Link,
+		Description: msg.Text,
+		Color:       msg.Color,
+	}
+
+	for _, f := range msg.Fields {
+		e.Fields = append(e.Fields, field{Name: f[0], Value: f[1], Inline: f[0] != "Failed targets"})
+	}
+
+	return struct {
+		Embeds []embed `json:"embeds"`
+	}{[]embed{e}}
+}
+
+// failedTargets returns the sorted names of the failed targets of info.
+func failedTargets(info buildInfo) []string {
+	failed := make([]string, 0, len(info.Failed))
+	for target := range info.Failed {
+		failed = append(failed, target)
+	}
+
+	sort.Strings(failed)
+
+	return failed
+}
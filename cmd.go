@@ -0,0 +1,1349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// usage is printed for unknown commands and by "beta help".
+const usage = `usage: beta [command] [flags]
+
+Commands:
+  serve    poll the repository and build new commits (default)
+  build    build the checked out commit, or the one given with -commit, once
+  prune    remove old builds from the output directory
+  promote  publish a build from the staging area, see -staging
+  version  print the version of beta and of Go
+
+Run "beta <command> -h" for the flags of a command. Flags which aren't given
+are read from the environment variable named after them, e.g. $BETA_FLAG_POLL
+for -poll, and then from the TOML file selected with -config, e.g.:
+
+  repo-url = "https://github.com/restic/restic"
+  poll = "5m"
+  targets = ["linux/amd64", "darwin/arm64"]
+
+  [smtp]
+  host = "mail.example.com"
+`
+
+func main() {
+	args := os.Args[1:]
+
+	// without a command, the flags are those of serve as before
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	switch name {
+	case "serve":
+		runServe(args)
+	case "build":
+		runBuild(args)
+	case "prune":
+		runPrune(args)
+	case "promote":
+		runPromote(args)
+	case "version":
+		runVersion(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%v", name, usage)
+		os.Exit(2)
+	}
+}
+
+// newFlagSet returns the flag set for the command name, it exits on errors.
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("beta "+name, flag.ExitOnError)
+}
+
+// settingNames returns the names of the flags of all commands, which are the
+// settings allowed in the config file.
+func settingNames() map[string]bool {
+	commands := []func(*flag.FlagSet){
+		func(fs *flag.FlagSet) {
+			addBuildFlags(fs)
+			addServeFlags(fs)
+			addBuildCommandFlags(fs)
+		},
+		func(fs *flag.FlagSet) { addPruneFlags(fs) },
+		func(fs *flag.FlagSet) { addPromoteFlags(fs) },
+	}
+
+	names := make(map[string]bool)
+
+	for _, add := range commands {
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		addLogFlags(fs)
+		add(fs)
+
+		fs.VisitAll(func(f *flag.Flag) {
+			names[f.Name] = true
+		})
+	}
+
+	return names
+}
+
+// logFlags configure logging, they are available for all commands.
+type logFlags struct {
+	level *string
+	json  *bool
+}
+
+func addLogFlags(fs *flag.FlagSet) *logFlags {
+	return &logFlags{
+		level: fs.String("log-level", "info", "only log messages with at least `level` (debug, info, warn, error)"),
+		json:  fs.Bool("log-json", false, "write log messages as JSON"),
+	}
+}
+
+func (f *logFlags) setup() {
+	err := setupLogging(*f.level, *f.json)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+}
+
+// buildFlags are the flags of the commands which build restic.
+type buildFlags struct {
+	targetsFile        *string
+	targetList         *string
+	skipInvalidTargets *bool
+	compress           *string
+	keep               *int
+	jobs               *int
+	uploads            *int
+	runTests           *bool
+	testTimeout        *time.Duration
+	vet                *bool
+	vetStrict          *bool
+	vetTimeout         *time.Duration
+	buildTimeout       *time.Duration
+	gocache            *string
+	gomodcache         *string
+	warm               *bool
+	repoURL            *string
+	shallow            *bool
+	gitProgress        *bool
+	gitTimeout         *time.Duration
+	forge              *string
+	sshKey             *string
+	ldflags            *string
+	buildArgs          *string
+	reproducible       *bool
+	verifyReproducible *bool
+	verifyBinaries     *bool
+	emulators          *string
+	cgo                *string
+	maxGrowth          *float64
+	incremental        *bool
+	postBuildHook      *string
+	postBuildHookFatal *bool
+	strip              *bool
+	upx                *bool
+	notarizeIdentity   *string
+	notarizeProfile    *string
+	pkg                *string
+	dryRun             *bool
+	s3Endpoint         *string
+	s3Bucket           *string
+	s3Region           *string
+	s3Prefix           *string
+	indexTemplate      *string
+	signTool           *string
+	signKey            *string
+	minFree            *int64
+	pruneLowSpace      *bool
+	dedup              *bool
+	layout             *string
+	staging            *bool
+	bundle             *bool
+	source             *bool
+	nameTemplate       *string
+	versionTemplate    *string
+	versionCommand     *string
+	minGoVersion       *string
+	goBinary           *string
+	profiles           *string
+	listTargets        *bool
+	rebuild            *bool
+	profileResources   *bool
+	windowsResources   *bool
+	windowsIcon        *string
+	windowsDescription *string
+	windowsCompany     *string
+	windowsCopyright   *string
+}
+
+func addBuildFlags(fs *flag.FlagSet) *buildFlags {
+	return &buildFlags{
+		targetsFile:        fs.String("targets-file", "targets.json", "read build targets from `file`"),
+		targetList:         fs.String("targets", "", "only build the comma-separated `list` of targets, e.g. linux/amd64,darwin/arm64"),
+		skipInvalidTargets: fs.Bool("skip-invalid-targets", false, "build the valid targets and only warn about invalid or unsupported ones instead of refusing to start"),
+		compress:           fs.String("compress", "none", "compress binaries with `method` (none, gzip, bzip2)"),
+		keep:               fs.Int("keep", 10, "keep the newest `n` builds, 0 disables pruning"),
+		jobs:               fs.Int("jobs", runtime.NumCPU(), "compile `n` targets concurrently, 1 serializes builds to save memory"),
+		uploads:            fs.Int("uploads", 3, "store `n` binaries concurrently, e.g. upload them to S3, independent of the number of -jobs"),
+		runTests:           fs.Bool("run-tests", false, "run the tests and only build if they pass"),
+		testTimeout:        fs.Duration("test-timeout", 30*time.Minute, "abort the tests after `duration`"),
+		vet:                fs.Bool("vet", false, "run go vet before building and report its findings in the build log and the notifications"),
+		vetStrict:          fs.Bool("vet-strict", false, "don't build if go vet reports issues, implies -vet"),
+		vetTimeout:         fs.Duration("vet-timeout", 10*time.Minute, "abort go vet after `duration`"),
+		buildTimeout:       fs.Duration("build-timeout", 10*time.Minute, "fail a target if compiling takes longer than `duration`, 0 disables the limit"),
+		gocache:            fs.String("gocache", "cache/go-build", "keep the Go build cache in `dir`, empty uses the default of the go command"),
+		gomodcache:         fs.String("gomodcache", "cache/mod", "keep downloaded modules in `dir`, empty uses the default of the go command"),
+		warm:               fs.Bool("warm-cache", false, "compile all packages for each target at startup to fill the build cache"),
+		repoURL:            fs.String("repo-url", "https://github.com/restic/restic", "clone the repository from `url`"),
+		shallow:            fs.Bool("shallow", false, "only clone and fetch the newest commits instead of the whole history, versions are then named after the commits"),
+		forge:              fs.String("forge", "", "link to commits in the web interface of the forge `type` hosting the repository (github, gitlab, gitea), defaults to the type of well-known hosts like gitlab.com or else github"),
+		gitProgress:        fs.Bool("git-progress", false, "log the progress of cloning and fetching the repository reported by git"),
+		gitTimeout:         fs.Duration("git-timeout", 15*time.Minute, "abort cloning, fetching or pulling the repository after `duration` so that a stalled connection is retried, 0 disables the limit"),
+		sshKey:             fs.String("ssh-key", "", "authenticate SSH URLs with the private key in `file`"),
+		ldflags:            fs.String("ldflags", defaultLDFlags, "pass linker flags rendered from the template `tmpl` to go build, the fields .Version and .Commit are available"),
+		pkg:                fs.String("package", defaultPackage, "build the main package at the relative `path` in the repository"),
+		buildArgs:          fs.String("build-args", "", "pass the extra `args` to go build, e.g. '-tags selfupdate', they override the builder's flags like -ldflags"),
+		reproducible:       fs.Bool("reproducible", false, "build binaries which are identical for the same commit and Go version"),
+		verifyReproducible: fs.Bool("verify-reproducible", false, "compile each target a second time and warn if the binaries differ, implies -reproducible"),
+		verifyBinaries:     fs.Bool("verify-binaries", false, "run the binaries built for this host with 'version' and fail the targets which don't print it"),
+		emulators:          fs.String("emulators", "", "also verify the binaries for other targets with the comma-separated `list` of os/arch=command pairs, e.g. linux/arm64=qemu-aarch64, implies -verify-binaries"),
+		cgo:                fs.String("cgo", "", "enable cgo for the comma-separated `list` of targets, e.g. linux/amd64, other platforms than the host need a C cross-compiler"),
+		maxGrowth:          fs.Float64("max-growth", 5, "warn if a binary is more than `percent` larger than in the previous version, 0 disables the warning"),
+		strip:              fs.Bool("strip", true, "strip debug information and file system paths from the binaries"),
+		upx:                fs.Bool("upx", false, "pack the executables with 'upx --best' for the targets UPX supports, this takes considerably longer"),
+		notarizeIdentity:   fs.String("notarize-identity", "", "sign the macOS binaries with the certificate `name` from the keychain and notarize them with xcrun notarytool, only possible on a Mac"),
+		notarizeProfile:    fs.String("notarize-profile", "beta", "authenticate to the notary service with the credentials stored in the keychain as `profile` with 'xcrun notarytool store-credentials'"),
+		dryRun:             fs.Bool("dry-run", false, "only log what would be built, don't build or write anything"),
+		s3Endpoint:         fs.String("s3-endpoint", "https://s3.amazonaws.com", "upload to the S3-compatible service at `url`"),
+		s3Bucket:           fs.String("s3-bucket", "", "upload builds to the S3 `bucket` instead of the output directory, credentials are read from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY"),
+		s3Region:           fs.String("s3-region", "us-east-1", "use the S3 `region`"),
+		s3Prefix:           fs.String("s3-prefix", "", "prepend `prefix` to the names of uploaded objects"),
+		indexTemplate:      fs.String("index-template", "", "render index.html in the output directory with the html/template in `file` instead of the built-in one"),
+		signTool:           fs.String("sign-tool", "gpg", "sign the checksums file with `tool` (gpg, minisign)"),
+		signKey:            fs.String("sign-key", "", "sign the checksums file with the gpg key ID or minisign secret key file `key`, empty disables signing"),
+		minFree:            fs.Int64("min-free", 1024, "don't start a build if less than `MiB` are available in the output directory, 0 disables the check"),
+		pruneLowSpace:      fs.Bool("prune-low-space", false, "remove the oldest builds if less than -min-free is available"),
+		goBinary:           fs.String("go", "go", "build with the go command at `path`, e.g. to use a specific toolchain"),
+		minGoVersion:       fs.String("min-go-version", "", "refuse to start if the go command is older than `version`, e.g. go1.21, defaults to the go directive in the go.mod of the repository"),
+		nameTemplate:       fs.String("name-template", defaultNameTemplate, "name the binaries after the template `tmpl`, the fields .Version, .Commit, .OS, .Arch (including the variant, e.g. armv7) and .Date and the function exe, which returns \".exe\" for windows, are available"),
+		versionTemplate:    fs.String("version-template", "", "derive the versions of the builds of branches from the template `tmpl`, the fields .Describe (the default), .Commit, .ShortCommit, .Tag, .Date and .Branch are available, e.g. '{{ .Date.Format \"2006.01.02\" }}-{{ .ShortCommit }}'"),
+		versionCommand:     fs.String("version-command", "", "derive the versions of the builds of branches from the output of `command`, run in the repository with $BETA_COMMIT, $BETA_BRANCH and $BETA_DESCRIBE set"),
+		postBuildHook:      fs.String("post-build-hook", "", "run the command at `path` after each successful build, with $BETA_VERSION, $BETA_COMMIT, $BETA_OUTPUT_DIR and $BETA_VERSION_DIR set"),
+		postBuildHookFatal: fs.Bool("post-build-hook-fatal", true, "fail the build if the post-build hook exits with an error"),
+		incremental:        fs.Bool("incremental", false, "publish each binary in the output directory as soon as it is built, the version directory is incomplete while building and after a failed build, not supported with S3"),
+		bundle:             fs.Bool("bundle", false, "also create restic-<version>.tar.gz containing the binaries, checksums and manifest"),
+		source:             fs.Bool("source", false, "also publish restic-<version>-source.tar.gz containing the source code of the commit, created with git archive"),
+		windowsResources:   fs.Bool("windows-resources", false, "embed version information into the Windows binaries, requires goversioninfo, otherwise they are built without"),
+		windowsIcon:        fs.String("windows-icon", "", "embed the icon in the .ico `file` into the Windows binaries, implies -windows-resources"),
+		windowsDescription: fs.String("windows-description", "restic backup program", "set the file description of the Windows binaries to `text`"),
+		windowsCompany:     fs.String("windows-company", "", "set the company name of the Windows binaries to `text`"),
+		windowsCopyright:   fs.String("windows-copyright", "", "set the copyright notice of the Windows binaries to `text`"),
+		profiles:           fs.String("profiles", "", "also build each target with each of the profiles listed in the JSON `file`, e.g. a debug build, into a subdirectory of the version named after the profile"),
+		profileResources:   fs.Bool("profile-resources", false, "log the memory usage, goroutines and running compilers every 10s while building and export them as metrics, for tuning -jobs"),
+		listTargets:        fs.Bool("list-targets", false, "print the targets which would be built and the names of their files, then exit"),
+		rebuild:            fs.Bool("rebuild", false, "compile all targets again instead of reusing the ones built successfully by a failed or interrupted build of the same commit"),
+		staging:            fs.Bool("staging", false, "publish new builds in the subdirectory 'staging' of the output directory, they are made available with 'beta promote' or POST /promote"),
+		dedup:              fs.Bool("dedup", false, "replace binaries identical to the previous version by hardlinks, mostly useful with -reproducible and -ldflags without the version"),
+		layout:             fs.String("layout", "versions", "arrange the output directory with `layout`: versions stores the files of each build in its directory, content stores each binary once in sha256/<hash> and links to it from the version directories"),
+	}
+}
+
+// config returns the configuration selected by the flags.
+func (f *buildFlags) config() (Config, error) {
+	if *f.jobs < 1 {
+		return Config{}, fmt.Errorf("invalid number of jobs %d", *f.jobs)
+	}
+
+	if *f.uploads < 1 {
+		return Config{}, fmt.Errorf("invalid number of uploads %d", *f.uploads)
+	}
+
+	cfg := Config{
+		Jobs:               *f.jobs,
+		Uploads:            *f.uploads,
+		Keep:               *f.keep,
+		RunTests:           *f.runTests,
+		TestTimeout:        *f.testTimeout,
+		Vet:                *f.vet || *f.vetStrict,
+		VetStrict:          *f.vetStrict,
+		VetTimeout:         *f.vetTimeout,
+		BuildTimeout:       *f.buildTimeout,
+		Strip:              *f.strip,
+		UPX:                *f.upx,
+		Reproducible:       *f.reproducible || *f.verifyReproducible,
+		VerifyReproducible: *f.verifyReproducible,
+		VerifyBinaries:     *f.verifyBinaries || *f.emulators != "",
+		Rebuild:            *f.rebuild,
+		ProfileResources:   *f.profileResources,
+		DryRun:             *f.dryRun,
+		MinFree:            *f.minFree << 20,
+		PruneLowSpace:      *f.pruneLowSpace,
+		Dedup:              *f.dedup,
+		Staging:            *f.staging,
+		Bundle:             *f.bundle,
+		Source:             *f.source,
+		MaxGrowth:          *f.maxGrowth,
+		Incremental:        *f.incremental,
+		PostBuildHook:      *f.postBuildHook,
+		PostBuildHookFatal: *f.postBuildHookFatal,
+	}
+
+	if *f.s3Bucket != "" {
+		cfg.S3 = &S3Config{
+			Endpoint:  *f.s3Endpoint,
+			Bucket:    *f.s3Bucket,
+			Region:    *f.s3Region,
+			Prefix:    *f.s3Prefix,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}
+
+		if cfg.S3.AccessKey == "" || cfg.S3.SecretKey == "" {
+			return Config{}, fmt.Errorf("S3 credentials missing, set $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+		}
+
+		if cfg.Staging {
+			return Config{}, fmt.Errorf("-staging is only supported for the output directory, not with S3")
+		}
+
+		if cfg.Incremental {
+			return Config{}, fmt.Errorf("-incremental is only supported for the output directory, not with S3")
+		}
+	}
+
+	var err error
+
+	cfg.LDFlags, err = template.New("ldflags").Option("missingkey=error").Parse(*f.ldflags)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid ldflags template: %w", err)
+	}
+
+	cfg.Targets, err = loadTargets(*f.targetsFile, *f.skipInvalidTargets)
+	if err != nil {
+		return Config{}, fmt.Errorf("unable to load build targets: %w", err)
+	}
+
+	if *f.targetList != "" {
+		cfg.Targets, err = filterTargets(cfg.Targets, *f.targetList)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid -targets: %w", err)
+		}
+	}
+
+	if *f.windowsResources || *f.windowsIcon != "" {
+		cfg.WindowsResources = &WindowsResources{
+			Description: *f.windowsDescription,
+			Company:     *f.windowsCompany,
+			Copyright:   *f.windowsCopyright,
+		}
+
+		if *f.windowsIcon != "" {
+			cfg.WindowsResources.Icon, err = filepath.Abs(*f.windowsIcon)
+			if err == nil && !exists(cfg.WindowsResources.Icon) {
+				err = fmt.Errorf("%v does not exist", *f.windowsIcon)
+			}
+
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid -windows-icon: %w", err)
+			}
+		}
+	}
+
+	cfg.Emulators, err = parseEmulators(cfg.Targets, *f.emulators)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid -emulators: %w", err)
+	}
+
+	if cfg.UPX {
+		_, err = exec.LookPath(upxBinary)
+		if err != nil {
+			return Config{}, fmt.Errorf("-upx requires upx: %w", err)
+		}
+	}
+
+	if *f.notarizeIdentity != "" {
+		if *f.notarizeProfile == "" {
+			return Config{}, fmt.Errorf("-notarize-identity requires -notarize-profile")
+		}
+
+		cfg.Notary = &Notary{Identity: *f.notarizeIdentity, Profile: *f.notarizeProfile}
+	}
+
+	cfg.Package, err = cleanPackage(*f.pkg)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid -package: %w", err)
+	}
+
+	err = validForge(*f.forge)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid -forge: %w", err)
+	}
+
+	cfg.CGO = make(map[string]bool)
+	if *f.cgo != "" {
+		targets, err := filterTargets(cfg.Targets, *f.cgo)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid -cgo: %w", err)
+		}
+
+		for _, target := range targets {
+			cfg.CGO[target.String()] = true
+		}
+	}
+
+	// the settings for targets above apply to all profiles
+	if *f.profiles != "" {
+		profiles, err := loadProfiles(*f.profiles)
+		if err != nil {
+			return Config{}, fmt.Errorf("unable to load build profiles: %w", err)
+		}
+
+		cfg.Profiles = make(map[string]BuildProfile, len(profiles))
+		for _, p := range profiles {
+			cfg.Profiles[p.Name] = p
+		}
+
+		cfg.Targets = expandProfiles(cfg.Targets, profiles)
+	}
+
+	cfg.BuildArgs, err = splitArgs(*f.buildArgs)
+	if err == nil {
+		err = checkBuildArgs(cfg.BuildArgs)
+	}
+
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid -build-args: %w", err)
+	}
+
+	cfg.Name, err = parseNameTemplate(*f.nameTemplate)
+	if err == nil {
+		// catch typos in field names before the first build
+		_, err = targetFilenames(cfg.Name, cfg.Targets, nameData{Version: "v0.0.0", Commit: "0000000", Date: time.Now()})
+	}
+
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid name template: %w", err)
+	}
+
+	if *f.versionTemplate != "" && *f.versionCommand != "" {
+		return Config{}, fmt.Errorf("-version-template and -version-command can't be used together")
+	}
+
+	if *f.versionTemplate != "" {
+		cfg.Version.Template, err = parseVersionTemplate(*f.versionTemplate)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid version template: %w", err)
+		}
+	}
+
+	if *f.versionCommand != "" {
+		cfg.Version.Command, err = splitArgs(*f.versionCommand)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid -version-command: %w", err)
+		}
+	}
+
+	cfg.Index, err = parseIndexTemplate(*f.indexTemplate)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid index template: %w", err)
+	}
+
+	if *f.signKey != "" {
+		if *f.signTool != "gpg" && *f.signTool != "minisign" {
+			return Config{}, fmt.Errorf("unknown signing tool %q", *f.signTool)
+		}
+
+		cfg.Sign = &SignConfig{Tool: *f.signTool, Key: *f.signKey}
+	}
+
+	cfg.Compress, err = parseCompression(*f.compress)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid compression: %w", err)
+	}
+
+	cfg.Layout, err = parseLayout(*f.layout)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid -layout: %w", err)
+	}
+
+	if cfg.Layout == LayoutContent {
+		switch {
+		case cfg.S3 != nil:
+			return Config{}, fmt.Errorf("-layout content is only supported for the output directory, not with S3")
+		case cfg.Staging:
+			return Config{}, fmt.Errorf("-layout content can't be combined with -staging")
+		case cfg.Incremental:
+			return Config{}, fmt.Errorf("-layout content can't be combined with -incremental")
+		case cfg.Dedup:
+			return Config{}, fmt.Errorf("-dedup is not needed with -layout content, identical binaries are stored once anyway")
+		}
+	}
+
+	return cfg, nil
+}
+
+// remote returns the upstream repository selected by the flags.
+func (f *buildFlags) remote() Remote {
+	return Remote{
+		URL:      *f.repoURL,
+		SSHKey:   *f.sshKey,
+		Shallow:  *f.shallow,
+		Progress: *f.gitProgress,
+		Timeout:  *f.gitTimeout,
+		Forge:    *f.forge,
+		// the token is only read from the environment so that it isn't
+		// visible in the process list
+		Token: os.Getenv("BETA_GIT_TOKEN"),
+	}
+}
+
+// prepare checks the Go toolchain and the targets in cfg, clones the
+// repositories if needed and locks them. It returns a context which is
+// canceled on SIGINT or SIGTERM and a function which releases the locks,
+// errors are fatal.
+func (f *buildFlags) prepare(cfg *Config, repos []Repo) (context.Context, context.CancelFunc) {
+	err := setupGoBinary(*f.goBinary)
+	if err != nil {
+		slog.Error("unable to find the go command", "err", err)
+		os.Exit(1)
+	}
+
+	err = setupGoCache(*f.gocache, *f.gomodcache)
+	if err != nil {
+		slog.Error("unable to set up Go cache", "err", err)
+		os.Exit(1)
+	}
+
+	v, err := goVersion()
+	if err != nil {
+		slog.Error("unable to get Go version", "err", err)
+		os.Exit(1)
+	}
+
+	slog.Info("detected Go", "version", v)
+	checkGoVersion(v, cfg.Targets)
+
+	supported, err := supportedTargets()
+	if err != nil {
+		slog.Error("unable to get supported targets", "err", err)
+		os.Exit(1)
+	}
+
+	cfg.Targets, err = validateTargets(cfg.Targets, supported, *f.skipInvalidTargets)
+	if err != nil {
+		slog.Error("invalid build targets", "err", err)
+		os.Exit(2)
+	}
+
+	for _, target := range cfg.Targets {
+		if target.Profile == "" && cfg.CGO[target.String()] && (target.OS != runtime.GOOS || target.Arch != runtime.GOARCH) {
+			slog.Warn("cgo is enabled for a target other than the host, this needs a C cross-compiler, e.g. configured via $CC", "target", target)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	var locks []*os.File
+
+	for _, r := range repos {
+		locks = append(locks, f.prepareRepo(ctx, *cfg, r, v))
+	}
+
+	return ctx, func() {
+		stop()
+
+		for _, lock := range locks {
+			if lock != nil {
+				_ = lock.Close()
+			}
+		}
+	}
+}
+
+// prepareRepo clones r if needed, locks it and checks that goVer is recent
+// enough to build it. It returns the lock file, which is nil if locking isn't
+// supported.
+func (f *buildFlags) prepareRepo(ctx context.Context, cfg Config, r Repo, goVer string) *os.File {
+	if !exists(r.Dir) {
+		err := retry(ctx, remoteAttempts, func() error {
+			return clone(ctx, r.Remote, r.Dir)
+		})
+		if isPermanent(err) {
+			slog.Error("clone failed permanently, check the URL and credentials", "repo", r.Name, "err", err)
+			os.Exit(1)
+		}
+
+		if err != nil {
+			slog.Error("clone failed", "repo", r.Name, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	lock, err := lockRepo(r.Dir)
+	if errors.Is(err, errLocked) {
+		slog.Error("another instance is using the repository, refusing to start", "repo", r.Name, "err", err)
+		os.Exit(1)
+	}
+
+	if err != nil {
+		slog.Warn("unable to lock the repository", "repo", r.Name, "err", err)
+	}
+
+	// builds are skipped until the output directory can be used, so that
+	// a file system mounted later is picked up
+	if !cfg.DryRun {
+		err = checkOutputDir(r.OutputDir)
+		if err != nil {
+			slog.Error("output directory not usable, builds are skipped until it is", "repo", r.Name, "err", err)
+		}
+	}
+
+	required := *f.minGoVersion
+	if required == "" {
+		required, err = modGoVersion(r.Dir)
+		if err != nil {
+			slog.Warn("unable to determine the minimum Go version", "repo", r.Name, "err", err)
+		}
+	}
+
+	if required != "" {
+		err := checkMinGoVersion(goVer, required)
+		if err != nil {
+			slog.Error("unsupported Go version", "repo", r.Name, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if *f.warm {
+		err := warmCache(ctx, r.Dir, cfg.Targets, cfg.Strip, cfg.CGO)
+		if err != nil {
+			// the builds still work, they are just slower
+			slog.Warn("warming build cache failed", "repo", r.Name, "err", err)
+		}
+	}
+
+	return lock
+}
+
+// serveFlags are the flags of the serve command besides the build flags.
+type serveFlags struct {
+	once               *bool
+	force              *bool
+	pollEvery          *time.Duration
+	pollJitter         *time.Duration
+	quiet              *time.Duration
+	statusFile         *string
+	webhookURL         *string
+	webhookType        *string
+	notifyFirstSuccess *bool
+	smtpHost           *string
+	smtpPort           *int
+	smtpFrom           *string
+	smtpTo             *string
+	smtpUser           *string
+	queue              *bool
+	worker             *string
+	listen             *string
+	healthThreshold    *time.Duration
+	ignorePaths        *string
+	tagPattern         *string
+	branches           *string
+	cleanAfter         *int
+	quarantine         *int
+	quarantineCooldown *time.Duration
+	maxBuildAge        *time.Duration
+	maxBuilds          *int
+	resetQuarantine    *bool
+	verifyPublished    *bool
+	verifyEachPoll     *bool
+	rebuildCorrupt     *bool
+	reposFile          *string
+}
+
+func addServeFlags(fs *flag.FlagSet) *serveFlags {
+	return &serveFlags{
+		once:               fs.Bool("once", false, "run a single update and build cycle, then exit"),
+		force:              fs.Bool("force", false, "build all branches in the first poll even if their commit has already been built, later rebuilds can be requested with POST /rebuild via -listen and $BETA_REBUILD_TOKEN"),
+		pollEvery:          fs.Duration("poll", defaultPollInterval, "check for new commits every `duration`"),
+		pollJitter:         fs.Duration("poll-jitter", 0, "vary each poll interval randomly by up to plus or minus `duration`, so that several builders don't hit the remote at the same time"),
+		quiet:              fs.Duration("quiet", 0, "only build a new commit once the branch hasn't changed for `duration`, so that a series of commits is built once, ignored with -once"),
+		statusFile:         fs.String("status-file", "status.json", "write the time and result of the last poll and builds to `file` after each poll, empty disables it"),
+		webhookURL:         fs.String("webhook-url", "", "send build notifications to `url`"),
+		webhookType:        fs.String("webhook-type", webhookGeneric, "format the notifications for the webhook `type` (generic, slack, discord), chat messages are only sent when a build fails or is fixed"),
+		notifyFirstSuccess: fs.Bool("notify-on-first-success", true, "notify via mail and chat webhooks when a branch builds successfully again after a failure"),
+		smtpHost:           fs.String("smtp-host", "", "send mails about failed builds via the SMTP server `host`, the password is read from $BETA_SMTP_PASSWORD"),
+		smtpPort:           fs.Int("smtp-port", 587, "connect to the SMTP server on `port`"),
+		smtpFrom:           fs.String("smtp-from", "", "send mails from `address`"),
+		smtpTo:             fs.String("smtp-to", "", "send mails to the comma-separated `addresses`"),
+		smtpUser:           fs.String("smtp-user", "", "authenticate to the SMTP server as `user`"),
+		queue:              fs.Bool("queue", false, "hand out build targets to remote workers via the HTTP server, requires -listen and the shared secret in $BETA_QUEUE_TOKEN"),
+		worker:             fs.String("worker", "", "run as a remote worker which builds targets handed out by the builder at `url`"),
+		listen:             fs.String("listen", "", "serve the build status, metrics and /healthz via HTTP on `addr`, e.g. :8080, POST /rebuild forces a rebuild if $BETA_REBUILD_TOKEN is set, POST /build starts a poll right away if $BETA_BUILD_TOKEN is set, POST /promote promotes staged builds if $BETA_PROMOTE_TOKEN is set"),
+		healthThreshold:    fs.Duration("health-threshold", 24*time.Hour, "report the builder as unhealthy via /healthz if no poll succeeded, or a branch failed to build or didn't build its new commits, for longer than `duration`"),
+		ignorePaths:        fs.String("ignore-paths", "doc/,*.md", "don't build commits which only change files matching the comma-separated `patterns`"),
+		tagPattern:         fs.String("tags", "", "also build each tag matching the glob `pattern` once, e.g. 'v*-rc.*'"),
+		branches:           fs.String("branches", "", "build the comma-separated `list` of branches into subdirectories instead of the checked out branch"),
+		cleanAfter:         fs.Int("clean", 0, "remove the clone and clone the repository again after `n` consecutive failed updates, 0 disables this"),
+		quarantine:         fs.Int("quarantine", 0, "skip a target after `n` consecutive failed builds of a branch, 0 disables this"),
+		quarantineCooldown: fs.Duration("quarantine-cooldown", 0, "retry quarantined targets after `duration`, 0 keeps them quarantined until -reset-quarantine is used"),
+		maxBuildAge:        fs.Duration("max-build-age", 0, "build the commit of a branch again if its last build is older than `duration`, e.g. to pick up a new Go version, 0 disables this"),
+		maxBuilds:          fs.Int("max-builds-per-hour", 0, "start at most `n` builds of each repository per hour, further commits are built once the limit allows it, 0 disables this"),
+		resetQuarantine:    fs.Bool("reset-quarantine", false, "build all quarantined targets again"),
+		verifyPublished:    fs.Bool("verify-published", false, "check the binaries of the latest published build of each branch against the manifest at startup and notify if they were modified"),
+		verifyEachPoll:     fs.Bool("verify-each-poll", false, "check the published binaries before each poll, implies -verify-published"),
+		rebuildCorrupt:     fs.Bool("rebuild-corrupt", false, "rebuild a branch if its published binaries were modified, implies -verify-published"),
+		reposFile:          fs.String("repos", "", "build the repositories listed in the JSON `file` instead of the one selected with -repo-url, each with its own clone, output directory, branches and state"),
+	}
+}
+
+// runServe polls the repository and builds new commits.
+func runServe(args []string) {
+	fs := newFlagSet("serve")
+	logs := addLogFlags(fs)
+	bf := addBuildFlags(fs)
+	f := addServeFlags(fs)
+	parseFlags(fs, args)
+
+	logs.setup()
+
+	if *f.pollEvery < minPollInterval {
+		slog.Error("poll interval too small", "poll", *f.pollEvery, "min", minPollInterval)
+		os.Exit(2)
+	}
+
+	if *f.quarantine < 0 || *f.quarantineCooldown < 0 {
+		slog.Error("invalid quarantine settings", "quarantine", *f.quarantine, "cooldown", *f.quarantineCooldown)
+		os.Exit(2)
+	}
+
+	if *f.maxBuildAge < 0 || (*f.maxBuildAge > 0 && *f.maxBuildAge < *f.pollEvery) {
+		slog.Error("invalid maximum build age", "max-build-age", *f.maxBuildAge, "poll", *f.pollEvery)
+		os.Exit(2)
+	}
+
+	if *f.maxBuilds < 0 {
+		slog.Error("invalid build limit", "max-builds-per-hour", *f.maxBuilds)
+		os.Exit(2)
+	}
+
+	if *f.healthThreshold < *f.pollEvery {
+		slog.Error("health threshold smaller than the poll interval", "threshold", *f.healthThreshold, "poll", *f.pollEvery)
+		os.Exit(2)
+	}
+
+	if *f.pollJitter < 0 {
+		slog.Error("invalid poll jitter", "jitter", *f.pollJitter)
+		os.Exit(2)
+	}
+
+	cfg, err := bf.config()
+	if err != nil {
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(2)
+	}
+
+	cfg.WebhookURL = *f.webhookURL
+	cfg.NotifyFirstSuccess = *f.notifyFirstSuccess
+
+	switch *f.webhookType {
+	case webhookGeneric, webhookSlack, webhookDiscord:
+		cfg.WebhookType = *f.webhookType
+	default:
+		slog.Error("invalid webhook type", "type", *f.webhookType)
+		os.Exit(2)
+	}
+
+	if !*f.once {
+		cfg.QuietPeriod = *f.quiet
+	}
+
+	cfg.TagPattern = *f.tagPattern
+	cfg.CleanAfter = *f.cleanAfter
+	cfg.QuarantineAfter = *f.quarantine
+	cfg.QuarantineCooldown = *f.quarantineCooldown
+	cfg.MaxBuildsPerHour = *f.maxBuilds
+	cfg.MaxBuildAge = *f.maxBuildAge
+	cfg.VerifyPublished = *f.verifyPublished || *f.verifyEachPoll || *f.rebuildCorrupt
+	cfg.VerifyEachPoll = *f.verifyEachPoll
+	cfg.RebuildCorrupt = *f.rebuildCorrupt
+
+	repos := []Repo{defaultRepo(bf.remote())}
+
+	if *f.branches != "" {
+		repos[0].Branches = strings.Split(*f.branches, ",")
+	}
+
+	if *f.reposFile != "" {
+		if *f.branches != "" {
+			slog.Error("-branches can't be used with -repos, list the branches in the file")
+			os.Exit(2)
+		}
+
+		repos, err = loadRepos(*f.reposFile, bf.remote())
+		if err != nil {
+			slog.Error("invalid list of repositories", "err", err)
+			os.Exit(2)
+		}
+	}
+
+	// the tags are published in the directory of that branch
+	if cfg.TagPattern != "" {
+		for _, r := range repos {
+			for _, branch := range r.Branches {
+				if branch == tagDirname {
+					slog.Error("-tags can't be used with a branch which is published in the directory of the tags", "repo", r.Name, "branch", branch)
+					os.Exit(2)
+				}
+			}
+		}
+	}
+
+	if *f.ignorePaths != "" {
+		cfg.IgnorePaths = strings.Split(*f.ignorePaths, ",")
+	}
+
+	if *f.smtpHost != "" {
+		if *f.smtpFrom == "" || *f.smtpTo == "" {
+			slog.Error("-smtp-host requires -smtp-from and -smtp-to")
+			os.Exit(2)
+		}
+
+		cfg.SMTP = &SMTPConfig{
+			Host:     *f.smtpHost,
+			Port:     *f.smtpPort,
+			From:     *f.smtpFrom,
+			To:       strings.Split(*f.smtpTo, ","),
+			Username: *f.smtpUser,
+			Password: os.Getenv("BETA_SMTP_PASSWORD"),
+		}
+	}
+
+	queueToken := os.Getenv("BETA_QUEUE_TOKEN")
+
+	// the workers only know a single repository
+	if (*f.queue || *f.worker != "") && len(repos) > 1 {
+		slog.Error("-queue and -worker can't be used with more than one repository")
+		os.Exit(2)
+	}
+
+	if *f.queue {
+		if *f.listen == "" {
+			slog.Error("-queue requires -listen")
+			os.Exit(2)
+		}
+
+		// anyone who can take jobs can also publish binaries
+		if queueToken == "" {
+			slog.Error("-queue requires $BETA_QUEUE_TOKEN")
+			os.Exit(2)
+		}
+
+		cfg.Queue = newJobQueue(queueToken)
+	}
+
+	if *bf.listTargets {
+		for _, r := range repos {
+			if len(repos) > 1 {
+				fmt.Printf("%v:\n", r.Name)
+			}
+
+			err = listTargets(cfg, r)
+			if err != nil {
+				slog.Error("listing targets failed", "repo", r.Name, "err", err)
+				os.Exit(1)
+			}
+		}
+
+		return
+	}
+
+	ctx, stop := bf.prepare(&cfg, repos)
+	defer stop()
+
+	if *f.worker != "" {
+		runWorker(ctx, *f.worker, queueToken, repos[0])
+		return
+	}
+
+	status := newStatus()
+
+	var daemons []*daemon
+
+	for _, r := range repos {
+		d, err := newDaemon(cfg, r, status)
+		if err != nil {
+			slog.Error("read state file failed", "repo", r.Name, "file", r.StateFile, "err", err)
+			os.Exit(1)
+		}
+
+		if *f.resetQuarantine {
+			n := d.state.resetQuarantine()
+			slog.Info("reset quarantined targets", "repo", r.Name, "targets", n)
+
+			err = d.saveState()
+			if err != nil {
+				os.Exit(1)
+			}
+		}
+
+		d.force.Store(*f.force)
+		daemons = append(daemons, d)
+	}
+
+	wake := make(chan struct{}, 1)
+	requests := newBuildRequests(os.Getenv("BETA_BUILD_TOKEN"), wake)
+
+	if *f.listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/status", status)
+		mux.Handle("/metrics", metricsHandler())
+		mux.Handle("/healthz", healthHandler{status: status, threshold: *f.healthThreshold})
+		// builds can only be requested with a token
+		if token := os.Getenv("BETA_REBUILD_TOKEN"); token != "" {
+			mux.Handle("/rebuild", rebuildHandler{daemons: daemons, wake: wake, token: token})
+		}
+
+		if requests.token != "" {
+			mux.Handle("/build", requests)
+			mux.Handle("/build/", requests)
+		}
+
+		if token := os.Getenv("BETA_PROMOTE_TOKEN"); token != "" && cfg.Staging {
+			mux.Handle("/promote", promoteHandler{daemons: daemons, token: token})
+		}
+
+		if cfg.Queue != nil {
+			mux.Handle("/queue/", cfg.Queue)
+		}
+
+		go func() {
+			err := serveHTTP(ctx, *f.listen, mux)
+			if err != nil {
+				slog.Error("HTTP server failed", "err", err)
+			}
+		}()
+	}
+
+	// the first poll happens right away, ticks are dropped while a build
+	// takes longer than the interval
+	ticker := time.NewTicker(*f.pollEvery)
+	defer ticker.Stop()
+
+	for {
+		var errs []error
+
+		requests.start()
+
+		for _, d := range daemons {
+			if ctx.Err() != nil {
+				break
+			}
+
+			err := d.poll(ctx)
+			if err != nil && len(daemons) > 1 {
+				err = fmt.Errorf("repo %v: %w", d.repo.Name, err)
+			}
+
+			errs = append(errs, err)
+		}
+
+		err = errors.Join(errs...)
+		status.polled(err)
+		requests.finish(err)
+
+		if *f.statusFile != "" && !cfg.DryRun {
+			serr := status.writeFile(*f.statusFile)
+			if serr != nil {
+				slog.Error("writing status file failed", "file", *f.statusFile, "err", serr)
+			}
+		}
+
+		if *f.once {
+			if err != nil {
+				os.Exit(1)
+			}
+
+			return
+		}
+
+		next := ticker.C
+		if *f.pollJitter > 0 {
+			// unlike with the ticker, the wait starts at the end of
+			// the poll
+			wait := jitter(*f.pollEvery, *f.pollJitter, minPollInterval)
+			slog.Debug("waiting for the next poll", "wait", wait)
+			next = time.After(wait)
+		}
+
+		select {
+		case <-next:
+		case <-wake:
+		case <-ctx.Done():
+			slog.Info("shutting down")
+			return
+		}
+	}
+}
+
+// buildCommandFlags are the flags of the build command besides the build flags.
+type buildCommandFlags struct {
+	commit  *string
+	repoDir *string
+}
+
+func addBuildCommandFlags(fs *flag.FlagSet) *buildCommandFlags {
+	return &buildCommandFlags{
+		commit:  fs.String("commit", "", "build `rev` instead of the checked out commit, the previous checkout is restored afterwards"),
+		repoDir: fs.String("repo-dir", "", "build the existing checkout in `dir` as it is, including uncommitted changes, instead of the cloned repository"),
+	}
+}
+
+// runBuild builds the commit checked out in the repository, without updating
+// it first, or the commit given with -commit. With -repo-dir, an existing
+// checkout is built instead of the clone. The state is not modified.
+func runBuild(args []string) {
+	fs := newFlagSet("build")
+	logs := addLogFlags(fs)
+	bf := addBuildFlags(fs)
+	f := addBuildCommandFlags(fs)
+	parseFlags(fs, args)
+
+	logs.setup()
+
+	cfg, err := bf.config()
+	if err != nil {
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(2)
+	}
+
+	repo := defaultRepo(bf.remote())
+
+	if *f.repoDir != "" {
+		// the working tree belongs to the user, it is never modified
+		if *f.commit != "" {
+			slog.Error("-commit can't be used with -repo-dir")
+			os.Exit(2)
+		}
+
+		if !exists(filepath.Join(*f.repoDir, ".git")) {
+			slog.Error("-repo-dir is not a git checkout", "dir", *f.repoDir)
+			os.Exit(2)
+		}
+
+		repo.Dir = *f.repoDir
+	}
+
+	if *bf.listTargets {
+		err = listTargets(cfg, repo)
+		if err != nil {
+			slog.Error("listing targets failed", "err", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	ctx, stop := bf.prepare(&cfg, []Repo{repo})
+
+	err = buildOnce(ctx, cfg, repo, *f.commit)
+	stop()
+
+	if err != nil {
+		slog.Error("build failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// listTargets prints the targets selected by cfg with the names of their
+// files for the checked out commit of repo. Placeholders are used for the
+// version and commit if it hasn't been cloned yet.
+func listTargets(cfg Config, repo Repo) error {
+	data := nameData{Version: "VERSION", Commit: "COMMIT", Date: time.Now()}
+
+	if exists(repo.Dir) {
+		version, err := deriveVersion(context.Background(), execGit{}, cfg.Version, repo.Dir, "", "")
+		if err != nil {
+			return err
+		}
+
+		commit, err := commitID(context.Background(), repo.Dir, "HEAD")
+		if err != nil {
+			return err
+		}
+
+		data.Version, data.Commit = version, commit
+	}
+
+	filenames, err := targetFilenames(cfg.Name, cfg.Targets, data)
+	if err != nil {
+		return err
+	}
+
+	printTargets(os.Stdout, cfg.Targets, filenames, cfg.Compress)
+
+	return nil
+}
+
+// buildOnce builds commit of repo, or the checked out commit if it is empty.
+func buildOnce(ctx context.Context, cfg Config, repo Repo, commit string) error {
+	if commit != "" {
+		restore, err := checkoutTemporarily(ctx, execGit{}, repo.Remote, repo.Dir, commit)
+		if err != nil {
+			return err
+		}
+
+		defer restore()
+	}
+
+	version, err := deriveVersion(ctx, execGit{}, cfg.Version, repo.Dir, "", "")
+	if err != nil {
+		return err
+	}
+
+	d := &daemon{cfg: cfg, repo: repo, git: execGit{}, log: slog.Default()}
+
+	if cfg.DryRun {
+		commit, err := commitID(ctx, repo.Dir, "HEAD")
+		if err != nil {
+			return err
+		}
+
+		return d.logPlan("", version, commit)
+	}
+
+	_, err = build(ctx, repo.Dir, d.publishdirFor(""), version, d.backendFor(""), cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.S3 == nil {
+		err = writeIndex(d.publishdirFor(""), cfg.Index)
+		if err != nil {
+			slog.Error("writing index failed", "err", err)
+		}
+	}
+
+	return nil
+}
+
+// pruneFlags are the flags of the prune command.
+type pruneFlags struct {
+	keep          *int
+	branches      *string
+	indexTemplate *string
+	reposFile     *string
+}
+
+func addPruneFlags(fs *flag.FlagSet) *pruneFlags {
+	return &pruneFlags{
+		keep:          fs.Int("keep", 10, "keep the newest `n` builds"),
+		branches:      fs.String("branches", "", "prune the subdirectories for the comma-separated `list` of branches instead of the output directory"),
+		indexTemplate: fs.String("index-template", "", "render index.html in the output directory with the html/template in `file` instead of the built-in one"),
+		reposFile:     fs.String("repos", "", "prune the output directories of the repositories listed in the JSON `file`"),
+	}
+}
+
+// runPrune removes old builds from the output directories of the branches.
+func runPrune(args []string) {
+	fs := newFlagSet("prune")
+	logs := addLogFlags(fs)
+	f := addPruneFlags(fs)
+	parseFlags(fs, args)
+
+	logs.setup()
+
+	if *f.keep < 1 {
+		slog.Error("invalid number of builds to keep", "keep", *f.keep)
+		os.Exit(2)
+	}
+
+	tmpl, err := parseIndexTemplate(*f.indexTemplate)
+	if err != nil {
+		slog.Error("invalid index template", "err", err)
+		os.Exit(2)
+	}
+
+	repos := []Repo{defaultRepo(Remote{})}
+
+	if *f.branches != "" {
+		repos[0].Branches = strings.Split(*f.branches, ",")
+	}
+
+	if *f.reposFile != "" {
+		repos, err = loadRepos(*f.reposFile, Remote{})
+		if err != nil {
+			slog.Error("invalid list of repositories", "err", err)
+			os.Exit(2)
+		}
+	}
+
+	failed := false
+
+	for _, r := range repos {
+		tracked := r.Branches
+		if len(tracked) == 0 {
+			tracked = []string{""}
+		}
+
+		for _, branch := range tracked {
+			err := pruneAndIndex(r.outputdirFor(branch), *f.keep, tmpl)
+			if err != nil {
+				slog.Error("prune failed", "repo", r.Name, "branch", branch, "err", err)
+				failed = true
+			}
+
+			staging := filepath.Join(r.outputdirFor(branch), stagingDirname)
+			if !exists(staging) {
+				continue
+			}
+
+			err = pruneAndIndex(staging, *f.keep, tmpl)
+			if err != nil {
+				slog.Error("prune failed", "repo", r.Name, "branch", branch, "dir", staging, "err", err)
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// promoteFlags are the flags of the promote command.
+type promoteFlags struct {
+	version       *string
+	branch        *string
+	keep          *int
+	indexTemplate *string
+	repoName      *string
+	reposFile     *string
+}
+
+func addPromoteFlags(fs *flag.FlagSet) *promoteFlags {
+	return &promoteFlags{
+		version:       fs.String("version", "", "promote the staged build of `version` instead of the latest one"),
+		branch:        fs.String("branch", "", "promote the build of `branch`, which is built into the subdirectory of that name, use 'rc' for tags"),
+		keep:          fs.Int("keep", 0, "afterwards remove all but the newest `n` builds from the output directory, 0 keeps all"),
+		indexTemplate: fs.String("index-template", "", "render index.html in the output directory with the html/template in `file` instead of the built-in one"),
+		repoName:      fs.String("repo", "", "promote the build of the repository `name` listed in the file given with -repos"),
+		reposFile:     fs.String("repos", "", "read the repositories from the JSON `file`"),
+	}
+}
+
+// runPromote publishes the latest build in the staging area of the output
+// directory, or the one selected with -version.
+func runPromote(args []string) {
+	fs := newFlagSet("promote")
+	logs := addLogFlags(fs)
+	f := addPromoteFlags(fs)
+	parseFlags(fs, args)
+
+	logs.setup()
+
+	tmpl, err := parseIndexTemplate(*f.indexTemplate)
+	if err != nil {
+		slog.Error("invalid index template", "err", err)
+		os.Exit(2)
+	}
+
+	repo := defaultRepo(Remote{})
+
+	if *f.reposFile != "" {
+		repos, err := loadRepos(*f.reposFile, Remote{})
+		if err != nil {
+			slog.Error("invalid list of repositories", "err", err)
+			os.Exit(2)
+		}
+
+		found := false
+		for _, r := range repos {
+			if r.Name == *f.repoName {
+				repo, found = r, true
+			}
+		}
+
+		if !found {
+			slog.Error("unknown repository, select one with -repo", "repo", *f.repoName)
+			os.Exit(2)
+		}
+	}
+
+	versiondir, err := promoteAndIndex(repo.outputdirFor(*f.branch), *f.version, *f.keep, tmpl)
+	if err != nil {
+		slog.Error("promotion failed", "err", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(versiondir)
+}
+
+func pruneAndIndex(dir string, keep int, tmpl *htmltemplate.Template) error {
+	err := pruneOldBuilds(dir, keep)
+	if err != nil {
+		return err
+	}
+
+	return writeIndex(dir, tmpl)
+}
+
+// runVersion prints the version of beta and the Go toolchain used for the
+// builds.
+func runVersion(args []string) {
+	fs := newFlagSet("version")
+	gobin := fs.String("go", "go", "report the version of the go command at `path`")
+	parseFlags(fs, args)
+
+	version := "(unknown)"
+	revision := ""
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		version = bi.Main.Version
+
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				revision = s.Value
+			}
+		}
+	}
+
+	fmt.Printf("beta %v", version)
+	if revision != "" {
+		fmt.Printf(" (%v)", revision)
+	}
+
+	fmt.Printf(" compiled with %v on %v/%v\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+
+	err := setupGoBinary(*gobin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to find the go command: %v\n", err)
+		os.Exit(1)
+	}
+
+	v, err := goVersion()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("builds with %v\n", v)
+}
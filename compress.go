@@ -0,0 +1,104 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Compression selects how the built binaries are compressed before they are
+// published.
+type Compression string
+
+// Supported compression methods.
+const (
+	CompressNone  Compression = "none"
+	CompressGzip  Compression = "gzip"
+	CompressBzip2 Compression = "bzip2"
+)
+
+func parseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case CompressNone, CompressGzip, CompressBzip2:
+		return c, nil
+	}
+
+	return "", fmt.Errorf("unknown compression %q, valid values are none, gzip and bzip2", s)
+}
+
+// Ext returns the filename extension for files compressed with c.
+func (c Compression) Ext() string {
+	switch c {
+	case CompressGzip:
+		return ".gz"
+	case CompressBzip2:
+		return ".bz2"
+	}
+
+	return ""
+}
+
+// compressFile replaces filename by a compressed version with the extension
+// c.Ext() appended to the name.
+func compressFile(c Compression, filename string) error {
+	switch c {
+	case CompressNone:
+		return nil
+	case CompressGzip:
+		return gzipFile(filename)
+	case CompressBzip2:
+		// the Go standard library can only decompress bzip2, so use the
+		// external program instead, it also removes the original file
+		cmd := exec.Command("bzip2", "--best", "--force", filename)
+		cmd.Stderr = os.Stderr
+
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("bzip2: %w", err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown compression %q", c)
+}
+
+func gzipFile(filename string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(filename + CompressGzip.Ext())
+	if err != nil {
+		return err
+	}
+
+	gw, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	_, err = io.Copy(gw, in)
+	if err == nil {
+		err = gw.Close()
+	}
+
+	if err == nil {
+		err = out.Close()
+	} else {
+		_ = out.Close()
+	}
+
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return fmt.Errorf("gzip: %w", err)
+	}
+
+	return os.Remove(filename)
+}
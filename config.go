@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// parseFlags parses args into fs and fills in the flags which weren't given
+// from the environment and the TOML file selected with -config. Flags take
+// precedence over environment variables, which take precedence over the file.
+// It exits on errors.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	configFile := fs.String("config", os.Getenv("BETA_CONFIG"), "read settings from the TOML `file`, the keys are the names of the flags, defaults to $BETA_CONFIG")
+	_ = fs.Parse(args)
+
+	err := applyConfig(fs, *configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+}
+
+// envName returns the name of the environment variable for the flag name, e.g.
+// BETA_FLAG_POLL for -poll. The prefix keeps them apart from the variables
+// set for hooks and version commands, like $BETA_VERSION, so that a beta run
+// from those doesn't pick them up as flags.
+func envName(name string) string {
+	return "BETA_FLAG_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyConfig sets the flags of fs which weren't given on the command line to
+// the values in the environment or in filename, if it isn't empty.
+func applyConfig(fs *flag.FlagSet, filename string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	values := make(map[string]string)
+
+	if filename != "" {
+		var doc map[string]any
+
+		_, err := toml.DecodeFile(filename, &doc)
+		if err != nil {
+			return fmt.Errorf("reading config file failed: %w", err)
+		}
+
+		err = flattenConfig("", doc, values)
+		if err != nil {
+			return fmt.Errorf("invalid config file %v: %w", filename, err)
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	known := settingNames()
+
+	for _, name := range names {
+		if !known[name] || name == "config" {
+			return fmt.Errorf("unknown setting %q in %v", name, filename)
+		}
+
+		// a file shared by all commands contains settings the others
+		// don't know
+		if fs.Lookup(name) == nil {
+			continue
+		}
+
+		if given[name] {
+			continue
+		}
+
+		err := fs.Set(name, values[name])
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %v in %v: %w", values[name], name, filename, err)
+		}
+	}
+
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || given[f.Name] || f.Name == "config" || err != nil {
+			return
+		}
+
+		setErr := fs.Set(f.Name, value)
+		if setErr != nil {
+			err = fmt.Errorf("invalid value %q in $%v: %w", value, envName(f.Name), setErr)
+		}
+	})
+
+	return err
+}
+
+// flattenConfig adds the settings in doc to values. The keys of tables are
+// prefixed with the name of the table, e.g. host in [smtp] sets -smtp-host.
+// Underscores in keys are the same as dashes. Arrays are joined with commas
+// like the lists passed to flags.
+func flattenConfig(prefix string, doc map[string]any, values map[string]string) error {
+	for key, v := range doc {
+		name := prefix + strings.ReplaceAll(key, "_", "-")
+
+		if table, ok := v.(map[string]any); ok {
+			err := flattenConfig(name+"-", table, values)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		value, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+
+		values[name] = value
+	}
+
+	return nil
+}
+
+// configValue returns the TOML value v as it would be passed to a flag.
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case []any:
+		list := make([]string, 0, len(v))
+
+		for _, elem := range v {
+			s, err := configValue(elem)
+			if err != nil {
+				return "", err
+			}
+
+			list = append(list, s)
+		}
+
+		return strings.Join(list, ","), nil
+	}
+
+	return "", fmt.Errorf("unsupported value %v of type %T", v, v)
+}
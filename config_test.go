@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		flag string
+		want string
+	}{
+		{"poll", "BETA_FLAG_POLL"},
+		{"smtp-host", "BETA_FLAG_SMTP_HOST"},
+		{"max-builds-per-hour", "BETA_FLAG_MAX_BUILDS_PER_HOUR"},
+	}
+
+	for _, test := range tests {
+		if got := envName(test.flag); got != test.want {
+			t.Errorf("envName(%q) = %q, want %q", test.flag, got, test.want)
+		}
+	}
+}
+
+const testConfig = `
+keep = 3
+branches = ["master", "next"]
+quarantine = 2
+
+[smtp]
+host = "mail.example.com"
+`
+
+func TestApplyConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		config string
+
+		// want maps the names of the flags to their values, or err is
+		// contained in the error.
+		want map[string]string
+		err  string
+	}{
+		{
+			name:   "file",
+			config: testConfig,
+			want: map[string]string{
+				"keep":      "3",
+				"branches":  "master,next",
+				"smtp-host": "mail.example.com",
+				"poll":      "1m0s",
+			},
+		},
+		{
+			name:   "env overrides file",
+			env:    map[string]string{"BETA_FLAG_KEEP": "5", "BETA_FLAG_POLL": "2m"},
+			config: testConfig,
+			want:   map[string]string{"keep": "5", "poll": "2m0s", "smtp-host": "mail.example.com"},
+		},
+		{
+			name:   "flags override env and file",
+			args:   []string{"-keep", "7"},
+			env:    map[string]string{"BETA_FLAG_KEEP": "5"},
+			config: testConfig,
+			want:   map[string]string{"keep": "7"},
+		},
+		{
+			name: "variables for hooks are ignored",
+			env:  map[string]string{"BETA_BRANCHES": "other"},
+			want: map[string]string{"branches": ""},
+		},
+		{
+			name:   "unknown setting",
+			config: "keep = 3\nkepe = 4\n",
+			err:    `unknown setting "kepe" in`,
+		},
+		{
+			name:   "unknown table",
+			config: "[smpt]\nhost = \"mail.example.com\"\n",
+			err:    `unknown setting "smpt-host" in`,
+		},
+		{
+			name:   "invalid value in file",
+			config: "keep = \"many\"\n",
+			err:    `invalid value "many" for keep`,
+		},
+		{
+			name: "invalid value in env",
+			env:  map[string]string{"BETA_FLAG_POLL": "often"},
+			err:  "$BETA_FLAG_POLL",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.Int("keep", 10, "")
+			fs.String("branches", "", "")
+			fs.String("smtp-host", "", "")
+			fs.Duration("poll", time.Minute, "")
+
+			err := fs.Parse(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filename := ""
+			if test.config != "" {
+				filename = filepath.Join(t.TempDir(), "beta.toml")
+
+				err := ioutil.WriteFile(filename, []byte(test.config), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = applyConfig(fs, filename)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+
+				if test.config != "" && !strings.Contains(err.Error(), filename) {
+					t.Errorf("error %q does not name the file", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, want := range test.want {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("%v is %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// daemon holds the state of the poll loop for a repository.
+type daemon struct {
+	cfg  Config
+	repo Repo
+
+	// git runs the git commands for polling the repository.
+	git Git
+
+	// log adds the name of the repository to the messages
+	log *slog.Logger
+
+	// state is saved to the state file of the repository after each
+	// build, except in dry-run mode.
+	state *State
+
+	// status is shared by the daemons of all repositories.
+	status *Status
+
+	// seen records when the current tip of each branch was first seen,
+	// for waiting until it has settled.
+	seen map[string]seenCommit
+
+	// failedUpdates counts the consecutive polls in which updating the
+	// clone failed.
+	failedUpdates int
+
+	// force requests building all branches in the next poll even if their
+	// commit hasn't changed, forcing is set while that poll runs.
+	force   atomic.Bool
+	forcing bool
+
+	// rebuild lists the branches which are built in the next poll even if
+	// their commit hasn't changed, because their published build is
+	// corrupt. A branch is removed once it has been built.
+	rebuild map[string]bool
+
+	// verified is set once the published builds have been verified.
+	verified bool
+}
+
+type seenCommit struct {
+	commit string
+	since  time.Time
+}
+
+// newDaemon returns a daemon for repo, the state and the build history are
+// loaded from the files of the repository.
+func newDaemon(cfg Config, repo Repo, status *Status) (*daemon, error) {
+	state, err := loadState(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	status.restore(repo.Name, state)
+
+	history, err := readHistory(repo.HistoryFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range history {
+		status.addHistory(repo.Name, entry)
+	}
+
+	log := slog.Default()
+	if repo.Name != "" {
+		log = log.With("repo", repo.Name)
+	}
+
+	return &daemon{
+		cfg:    cfg,
+		repo:   repo,
+		git:    execGit{},
+		log:    log,
+		state:  state,
+		status: status,
+	}, nil
+}
+
+// poll updates the repository and builds each branch whose commit differs
+// from the one recorded in d.state, which is updated accordingly. Without
+// configured branches, the checked out branch is pulled and built.
+func (d *daemon) poll(ctx context.Context) error {
+	cfg := d.cfg
+
+	setState(statePolling)
+	defer setState(stateIdle)
+
+	if cfg.VerifyPublished && (!d.verified || cfg.VerifyEachPoll) {
+		d.verifyPublished()
+	}
+
+	d.forcing = d.force.Swap(false)
+	defer func() {
+		d.forcing = false
+	}()
+
+	if len(d.repo.Branches) == 0 {
+		err := retry(ctx, remoteAttempts, func() error {
+			// don't modify the working tree in dry-run mode
+			if cfg.DryRun {
+				return d.git.Fetch(ctx, d.repo.Remote, d.repo.Dir)
+			}
+
+			return d.git.Pull(ctx, d.repo.Remote, d.repo.Dir)
+		})
+		if err != nil {
+			d.logRemoteError("update failed", err)
+			d.updateFailed(ctx, err)
+			d.retryForce()
+
+			return err
+		}
+
+		d.failedUpdates = 0
+
+		err = d.pollBranch(ctx, "")
+		if cfg.TagPattern == "" || ctx.Err() != nil {
+			return err
+		}
+
+		return errors.Join(err, d.pollTags(ctx))
+	}
+
+	err := retry(ctx, remoteAttempts, func() error {
+		return d.git.Fetch(ctx, d.repo.Remote, d.repo.Dir)
+	})
+	if err != nil {
+		d.logRemoteError("fetch failed", err)
+		d.updateFailed(ctx, err)
+		d.retryForce()
+
+		return err
+	}
+
+	d.failedUpdates = 0
+
+	var errs []error
+
+	for _, branch := range d.repo.Branches {
+		if ctx.Err() != nil {
+			break
+		}
+
+		err := d.pollBranch(ctx, branch)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("branch %v: %w", branch, err))
+		}
+	}
+
+	if cfg.TagPattern != "" && ctx.Err() == nil {
+		err := d.pollTags(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tags: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// rebuildHandler serves POST /rebuild, which requests a forced rebuild of all
+// branches of the repositories, or only of the one named in the parameter
+// "repo", and wakes up the poll loop.
+type rebuildHandler struct {
+	daemons []*daemon
+	wake    chan<- struct{}
+
+	// token must be sent as a bearer token
+	token string
+}
+
+func (h rebuildHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, h.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("repo")
+	found := false
+
+	for _, d := range h.daemons {
+		if name == "" || d.repo.Name == name {
+			d.force.Store(true)
+			found = true
+		}
+	}
+
+	if !found {
+		http.Error(w, "unknown repository", http.StatusNotFound)
+		return
+	}
+
+	slog.Info("forced rebuild requested", "repo", name, "remote", r.RemoteAddr)
+
+	// a poll which is already running doesn't pick up the request, the
+	// buffered channel makes the next one start right afterwards
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// retryForce keeps a forced rebuild requested for the next poll if the current
+// one failed before building the branches.
+func (d *daemon) retryForce() {
+	if d.forcing {
+		d.force.Store(true)
+	}
+}
+
+// updateFailed records that updating the clone failed with err. After
+// cfg.CleanAfter consecutive failures, the clone is assumed to be broken, e.g.
+// by an interrupted pull, and is replaced by a fresh one. Permanent errors,
+// like wrong credentials, are not fixed by this, and only errors of git
+// itself are counted.
+func (d *daemon) updateFailed(ctx context.Context, err error) {
+	if d.cfg.CleanAfter <= 0 || d.cfg.DryRun || isPermanent(err) || ctx.Err() != nil {
+		return
+	}
+
+	if !errors.As(err, new(UpdateError)) {
+		return
+	}
+
+	d.failedUpdates++
+	if d.failedUpdates < d.cfg.CleanAfter {
+		return
+	}
+
+	d.log.Warn("updating failed repeatedly, cloning the repository again", "dir", d.repo.Dir, "failures", d.failedUpdates)
+
+	err = reclone(ctx, d.git, d.repo.Remote, d.repo.Dir)
+	if err != nil {
+		d.log.Error("cloning the repository again failed", "dir", d.repo.Dir, "err", err)
+		return
+	}
+
+	d.log.Warn("cloned the repository again", "dir", d.repo.Dir)
+	d.failedUpdates = 0
+}
+
+// pollBranch builds branch if its commit has changed.
+func (d *daemon) pollBranch(ctx context.Context, branch string) error {
+	cfg := d.cfg
+
+	rev := "HEAD"
+	if branch != "" {
+		rev = "origin/" + branch
+	} else if cfg.DryRun {
+		rev = "@{upstream}"
+	}
+
+	newCommit, err := d.git.RevParse(ctx, d.repo.Dir, rev)
+	if err != nil {
+		d.log.Error("unable to find commit", "branch", branch, "err", err)
+		return err
+	}
+
+	oldCommit := d.state.commit(branch)
+	age, aged := d.buildAge(branch)
+
+	d.status.seen(d.repo.Name, branch, newCommit, oldCommit == newCommit)
+
+	forced := d.forcing || d.rebuild[branch]
+
+	switch {
+	case forced:
+		d.log.Info("forced rebuild", "branch", branch, "old", oldCommit, "new", newCommit)
+	case oldCommit == newCommit && aged:
+		d.log.Info("last build is too old, rebuilding the same commit", "branch", branch, "commit", newCommit, "age", age.Round(time.Minute), "max", cfg.MaxBuildAge)
+	case oldCommit == newCommit || !d.settled(branch, newCommit):
+		return nil
+	default:
+		d.log.Info("commit changed", "branch", branch, "old", oldCommit, "new", newCommit)
+	}
+
+	if !forced && oldCommit != newCommit && oldCommit != "" && len(cfg.IgnorePaths) > 0 {
+		files, err := d.git.ChangedFiles(ctx, d.repo.Dir, oldCommit, newCommit)
+		if err != nil {
+			// e.g. the old commit is gone after a force push
+			d.log.Warn("unable to list changed files", "branch", branch, "err", err)
+		} else if onlyIgnored(files, cfg.IgnorePaths) {
+			d.log.Info("only ignored files changed, skipping build", "branch", branch, "files", len(files))
+			d.state.setCommit(branch, newCommit)
+
+			return d.saveState()
+		}
+	}
+
+	if cfg.DryRun {
+		// only remember the commit in memory so that the plan is not
+		// logged again on the next poll
+		d.state.setCommit(branch, newCommit)
+		delete(d.rebuild, branch)
+
+		version, err := deriveVersion(ctx, d.git, cfg.Version, d.repo.Dir, branch, newCommit)
+		if err != nil {
+			return err
+		}
+
+		return d.logPlan(branch, version, newCommit)
+	}
+
+	// a missing or read-only output directory, e.g. an unmounted network
+	// file system, would only make the build fail after compiling. The
+	// commit isn't recorded, so it is built once the directory is back.
+	dir := d.publishdirFor(branch)
+
+	err = checkOutputDir(dir)
+	if err != nil {
+		d.log.Error("output directory not usable, skipping build", "branch", branch, "err", err)
+		return err
+	}
+
+	// the commit isn't recorded, so the next poll builds the tip of the
+	// branch at that time
+	if !d.buildAllowed("branch", branch, "commit", newCommit) {
+		return nil
+	}
+
+	if branch != "" {
+		err = d.git.Checkout(ctx, d.repo.Dir, newCommit)
+		if err != nil {
+			d.log.Error("checkout failed", "branch", branch, "err", err)
+			return err
+		}
+	}
+
+	version, err := deriveVersion(ctx, d.git, cfg.Version, d.repo.Dir, branch, "")
+	if err != nil {
+		return err
+	}
+
+	d.state.addBuildTime(time.Now())
+
+	buildCfg := d.skipQuarantined(branch, cfg)
+	buildCfg.Progress = d.status.startBuild(d.repo.Name, branch, version, buildCfg.Targets)
+
+	setState(stateBuilding)
+	info, buildErr := build(ctx, d.repo.Dir, dir, version, d.backendFor(branch), buildCfg)
+	setState(statePolling)
+	buildCfg.Progress.finish()
+
+	switch {
+	case ctx.Err() != nil:
+		// the commit has not been built completely, so don't record it
+		d.log.Info("build interrupted", "branch", branch)
+		return buildErr
+	case errors.As(buildErr, new(DiskFullError)):
+		// nothing was built, the next poll tries again
+		d.log.Warn("not enough disk space, skipping build", "branch", branch, "err", buildErr)
+		return buildErr
+	}
+
+	if buildErr != nil {
+		d.log.Error("build failed", "branch", branch, "stage", failureStage(buildErr), "err", buildErr)
+	}
+
+	failedBefore := false
+	if bs, ok := d.state.Branches[branch]; ok {
+		failedBefore = bs.LastError != ""
+	}
+
+	d.status.update(d.repo.Name, branch, newCommit, info, buildErr)
+	d.recordHistory(branch, newCommit, info, buildErr)
+	recordBuild(buildErr)
+	d.notify(branch, newCommit, info, buildErr, failedBefore)
+
+	// old builds are only pruned from the local file system
+	if buildErr == nil && cfg.Keep > 0 && cfg.S3 == nil {
+		err = pruneOldBuilds(dir, cfg.Keep)
+		if err != nil {
+			d.log.Error("prune old builds failed", "err", err)
+		}
+	}
+
+	if buildErr == nil && cfg.S3 == nil {
+		err = writeIndex(dir, cfg.Index)
+		if err != nil {
+			d.log.Error("writing index failed", "err", err)
+		}
+	}
+
+	d.state.setBuilt(branch, newCommit, buildErr)
+	d.recordTargets(branch, info)
+	delete(d.rebuild, branch)
+
+	err = d.saveState()
+	if buildErr != nil {
+		return buildErr
+	}
+
+	return err
+}
+
+// buildAge returns the time since branch was built last and whether that is
+// longer than cfg.MaxBuildAge, so that the commit is built again.
+func (d *daemon) buildAge(branch string) (time.Duration, bool) {
+	bs, ok := d.state.Branches[branch]
+	if !ok || bs.LastBuild.IsZero() || d.cfg.MaxBuildAge <= 0 {
+		return 0, false
+	}
+
+	age := time.Since(bs.LastBuild)
+
+	return age, age > d.cfg.MaxBuildAge
+}
+
+// settled reports whether commit has been the tip of branch for at least
+// cfg.QuietPeriod, so that commits pushed in quick succession are built only
+// once.
+func (d *daemon) settled(branch, commit string) bool {
+	if d.cfg.QuietPeriod <= 0 {
+		return true
+	}
+
+	if d.seen == nil {
+		d.seen = make(map[string]seenCommit)
+	}
+
+	seen, ok := d.seen[branch]
+	if !ok || seen.commit != commit {
+		d.log.Info("new commit, waiting until the branch settles", "branch", branch, "commit", commit, "quiet", d.cfg.QuietPeriod)
+		d.seen[branch] = seenCommit{commit: commit, since: time.Now()}
+
+		return false
+	}
+
+	remaining := d.cfg.QuietPeriod - time.Since(seen.since)
+	if remaining > 0 {
+		d.log.Debug("waiting until the branch settles", "branch", branch, "commit", commit, "remaining", remaining)
+		return false
+	}
+
+	return true
+}
+
+// notify sends the notifications about a build of commit on branch. Mails are
+// only sent if the build failed or, with cfg.NotifyFirstSuccess, succeeded
+// for the first time after a failure, which is indicated by failedBefore. As
+// failedBefore is taken from the state file, restarting the daemon doesn't
+// report a recovery again.
+func (d *daemon) notify(branch, commit string, info buildInfo, buildErr error, failedBefore bool) {
+	cfg := d.cfg
+
+	recovered := buildErr == nil && failedBefore
+	if recovered {
+		d.log.Info("build recovered", "branch", branch, "version", info.Version)
+	}
+
+	// chat messages are only sent when the outcome changes, like mails
+	changed := (buildErr != nil && !failedBefore) || (recovered && cfg.NotifyFirstSuccess)
+
+	if cfg.WebhookURL != "" && (cfg.WebhookType == webhookGeneric || changed) {
+		err := notifyWebhook(cfg.WebhookURL, cfg.WebhookType, newWebhookPayload(d.repo, branch, commit, info, buildErr, recovered))
+		if err != nil {
+			d.log.Error("webhook notification failed", "err", err)
+		}
+	}
+
+	if cfg.SMTP != nil && changed {
+		logdir := filepath.Join(d.publishdirFor(branch), "restic-"+info.Version)
+		if buildErr != nil {
+			logdir = failureLogDir(d.publishdirFor(branch), info.Version, cfg.Incremental)
+		}
+
+		err := notifyMail(*cfg.SMTP, d.repo.Name, branch, commit, logdir, info, buildErr)
+		if err != nil {
+			d.log.Error("mail notification failed", "err", err)
+		}
+	}
+}
+
+// recordHistory appends the durations of the build of commit on branch to the
+// history file and the status.
+func (d *daemon) recordHistory(branch, commit string, info buildInfo, buildErr error) {
+	entry := newHistoryEntry(branch, commit, info, buildErr)
+	d.status.addHistory(d.repo.Name, entry)
+
+	err := appendHistory(d.repo.HistoryFile, entry)
+	if err != nil {
+		d.log.Error("write history file failed", "file", d.repo.HistoryFile, "err", err)
+	}
+}
+
+// saveState writes d.state to the state file of the repository. In dry-run
+// mode, the state is only kept in memory.
+func (d *daemon) saveState() error {
+	if d.cfg.DryRun {
+		return nil
+	}
+
+	err := d.state.save(d.repo.StateFile)
+	if err != nil {
+		d.log.Error("write state file failed", "file", d.repo.StateFile, "err", err)
+	}
+
+	return err
+}
+
+// onlyIgnored returns true if all files match one of the patterns, see
+// Config.IgnorePaths.
+func onlyIgnored(files, patterns []string) bool {
+	for _, file := range files {
+		if !matchesAny(file, patterns) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchesAny(file string, patterns []string) bool {
+	for _, pattern := range patterns {
+		switch {
+		case strings.HasSuffix(pattern, "/"):
+			if strings.HasPrefix(file, pattern) {
+				return true
+			}
+		case !strings.Contains(pattern, "/"):
+			if ok, _ := path.Match(pattern, path.Base(file)); ok {
+				return true
+			}
+		default:
+			if ok, _ := path.Match(pattern, file); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// backendFor returns the backend the builds for branch are published to.
+func (d *daemon) backendFor(branch string) Backend {
+	if d.cfg.S3 != nil {
+		return newS3Backend(*d.cfg.S3, path.Join(d.repo.Name, branchDirname(branch)))
+	}
+
+	if d.cfg.Layout == LayoutContent {
+		return contentBackend{outputdir: d.publishdirFor(branch)}
+	}
+
+	return localBackend{outputdir: d.publishdirFor(branch), dedup: d.cfg.Dedup}
+}
+
+// logPlan logs what building version at commit on branch would produce,
+// without actually building anything.
+func (d *daemon) logPlan(branch, version, commit string) error {
+	cfg := d.cfg
+	dir := filepath.Join(d.publishdirFor(branch), "restic-"+version)
+
+	filenames, err := targetFilenames(cfg.Name, cfg.Targets, nameData{Version: version, Commit: commit, Date: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	d.log.Info("dry run: would build", "branch", branch, "version", version, "dir", dir)
+
+	for _, target := range cfg.Targets {
+		d.log.Info("dry run: would build target", "os", target.OS, "arch", target.ArchName(),
+			"file", filepath.Join(dir, filenames[target.String()]+cfg.Compress.Ext()))
+	}
+
+	return nil
+}
+
+// logRemoteError logs an error from talking to the remote repository,
+// permanent errors which need manual intervention are highlighted and
+// interruptions by shutting down are not reported as errors.
+func (d *daemon) logRemoteError(msg string, err error) {
+	if errors.Is(err, context.Canceled) {
+		d.log.Info(msg + ", interrupted")
+		return
+	}
+
+	if isPermanent(err) {
+		d.log.Error(msg+", manual intervention required", "err", err)
+		return
+	}
+
+	d.log.Error(msg, "err", err)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+const (
+	testCommit1 = "1111111111111111111111111111111111111111"
+	testCommit2 = "2222222222222222222222222222222222222222"
+)
+
+// newTestDaemon returns a daemon for a repository with the branch master,
+// which is polled with g. The files are written to a temporary directory.
+func newTestDaemon(t *testing.T, cfg Config, g Git) *daemon {
+	dir := t.TempDir()
+
+	if cfg.Name == nil {
+		cfg.Name = template.Must(parseNameTemplate(defaultNameTemplate))
+	}
+
+	if cfg.Targets == nil {
+		cfg.Targets = []BuildTarget{{OS: "linux", Arch: "amd64"}}
+	}
+
+	return &daemon{
+		cfg: cfg,
+		repo: Repo{
+			Dir:         filepath.Join(dir, "repo"),
+			OutputDir:   filepath.Join(dir, "out"),
+			StateFile:   filepath.Join(dir, "state.json"),
+			HistoryFile: filepath.Join(dir, "history.jsonl"),
+			Branches:    []string{"master"},
+		},
+		git:    g,
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		state:  &State{Branches: make(map[string]*BranchState)},
+		status: newStatus(),
+	}
+}
+
+func TestPollUnchangedCommit(t *testing.T) {
+	g := newFakeGit(map[string]string{"origin/master": testCommit1})
+	d := newTestDaemon(t, Config{}, g)
+	d.state.setCommit("master", testCommit1)
+
+	err := d.poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.called("Fetch") != 1 {
+		t.Errorf("Fetch called %d times, want 1", g.called("Fetch"))
+	}
+
+	if g.called("Checkout") != 0 {
+		t.Errorf("unchanged commit was checked out")
+	}
+}
+
+func TestPollFetchFailed(t *testing.T) {
+	g := newFakeGit(map[string]string{"origin/master": testCommit2})
+	g.fetchErr = permanentError{errors.New("authentication failed")}
+
+	d := newTestDaemon(t, Config{}, g)
+	d.state.setCommit("master", testCommit1)
+	d.force.Store(true)
+
+	err := d.poll(context.Background())
+	if err == nil {
+		t.Fatal("poll succeeded although fetching failed")
+	}
+
+	if g.called("RevParse") != 0 {
+		t.Errorf("branch was polled although fetching failed")
+	}
+
+	if !d.force.Load() {
+		t.Errorf("forced rebuild was not kept for the next poll")
+	}
+}
+
+func TestPollOnlyIgnoredFiles(t *testing.T) {
+	g := newFakeGit(map[string]string{"origin/master": testCommit2})
+	g.changed[testCommit1+".."+testCommit2] = []string{"README.md", "doc/index.rst"}
+
+	d := newTestDaemon(t, Config{IgnorePaths: []string{"*.md", "doc/"}}, g)
+	d.state.setCommit("master", testCommit1)
+
+	err := d.poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.called("Checkout") != 0 {
+		t.Errorf("commit changing only ignored files was checked out")
+	}
+
+	state, err := loadState(d.repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := state.commit("master"); c != testCommit2 {
+		t.Errorf("saved commit is %v, want %v", c, testCommit2)
+	}
+}
+
+func TestPollOutputDirMissing(t *testing.T) {
+	g := newFakeGit(map[string]string{"origin/master": testCommit2})
+	d := newTestDaemon(t, Config{}, g)
+	d.repo.OutputDir = filepath.Join(t.TempDir(), "not", "mounted")
+	d.state.setCommit("master", testCommit1)
+
+	err := d.poll(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "mounted") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if g.called("Checkout") != 0 {
+		t.Errorf("commit was checked out although the output directory is missing")
+	}
+
+	// the commit is built once the directory is back
+	if c := d.state.commit("master"); c != testCommit1 {
+		t.Errorf("commit is %v, want %v", c, testCommit1)
+	}
+}
+
+func TestPollDryRun(t *testing.T) {
+	g := newFakeGit(map[string]string{"origin/master": testCommit2})
+	d := newTestDaemon(t, Config{DryRun: true}, g)
+	d.state.setCommit("master", testCommit1)
+
+	for i := 0; i < 2; i++ {
+		err := d.poll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if g.called("Checkout") != 0 {
+		t.Errorf("working tree was modified in dry-run mode")
+	}
+
+	// the plan is only logged once
+	if g.called("Describe") != 1 {
+		t.Errorf("Describe called %d times, want 1", g.called("Describe"))
+	}
+
+	if c := d.state.commit("master"); c != testCommit2 {
+		t.Errorf("commit is %v, want %v", c, testCommit2)
+	}
+}
+
+func TestPollQuietPeriod(t *testing.T) {
+	g := newFakeGit(map[string]string{"origin/master": testCommit2})
+	d := newTestDaemon(t, Config{DryRun: true, QuietPeriod: time.Hour}, g)
+	d.state.setCommit("master", testCommit1)
+
+	err := d.poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := d.state.commit("master"); c != testCommit1 {
+		t.Errorf("commit %v was handled before the branch settled", c)
+	}
+
+	// pretend the commit was seen an hour ago
+	d.seen["master"] = seenCommit{commit: testCommit2, since: time.Now().Add(-2 * time.Hour)}
+
+	err = d.poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := d.state.commit("master"); c != testCommit2 {
+		t.Errorf("commit is %v, want %v", c, testCommit2)
+	}
+}
+
+func TestPollTagsDryRun(t *testing.T) {
+	g := newFakeGit(map[string]string{
+		"origin/master": testCommit1,
+		"v0.2.0":        testCommit2,
+	})
+	g.tags = []string{"v0.1.0", "v0.2.0", "v0.3.0/../../x", "other"}
+
+	d := newTestDaemon(t, Config{DryRun: true, TagPattern: "v*"}, g)
+	d.state.setCommit("master", testCommit1)
+	d.state.addTag("v0.1.0")
+
+	err := d.poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !d.state.tagBuilt("v0.2.0") {
+		t.Errorf("new tag was not handled")
+	}
+
+	if d.state.tagBuilt("other") {
+		t.Errorf("tag not matching the pattern was handled")
+	}
+
+	// the invalid tag is skipped, but not reported again
+	if !d.state.tagBuilt("v0.3.0/../../x") {
+		t.Errorf("invalid tag was not recorded")
+	}
+
+	if g.called("RevParse") != 2 {
+		t.Errorf("RevParse called %d times, want 2", g.called("RevParse"))
+	}
+}
+
+func TestPollRebuildCorrupt(t *testing.T) {
+	g := newFakeGit(map[string]string{
+		"origin/master": testCommit1,
+		"origin/next":   testCommit2,
+	})
+
+	d := newTestDaemon(t, Config{DryRun: true, TagPattern: "v*"}, g)
+	d.repo.Branches = []string{"master", "next"}
+	d.state.setCommit("master", testCommit1)
+	d.state.setCommit("next", testCommit2)
+	d.state.addTag("v0.1.0")
+
+	d.rebuildCorrupt("next", "v0.2.0-1-g2222222")
+	d.rebuildCorrupt(tagBranch, "v0.1.0")
+
+	if d.state.tagBuilt("v0.1.0") {
+		t.Errorf("corrupted tag build is still marked as built")
+	}
+
+	for i := 0; i < 2; i++ {
+		err := d.poll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the plan for next is logged, and only once
+	if g.called("Describe") != 1 {
+		t.Errorf("Describe called %d times, want 1", g.called("Describe"))
+	}
+
+	if d.rebuild["next"] {
+		t.Errorf("rebuild of next is still requested")
+	}
+}
+
+func TestRebuildHandler(t *testing.T) {
+	d := newTestDaemon(t, Config{}, newFakeGit(nil))
+	d.repo.Name = "restic"
+
+	wake := make(chan struct{}, 1)
+	h := rebuildHandler{daemons: []*daemon{d}, wake: wake, token: "secret"}
+
+	request := func(path, token string) int {
+		req := httptest.NewRequest(http.MethodPost, path, http.NoBody)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	for _, token := range []string{"wrong", "secre", ""} {
+		if code := request("/rebuild", token); code != http.StatusUnauthorized {
+			t.Errorf("request with the token %q returned %v", token, code)
+		}
+	}
+
+	if code := request("/rebuild?repo=other", "secret"); code != http.StatusNotFound {
+		t.Errorf("request for an unknown repository returned %v", code)
+	}
+
+	if d.force.Load() {
+		t.Fatal("rebuild forced by a rejected request")
+	}
+
+	if code := request("/rebuild?repo=restic", "secret"); code != http.StatusAccepted {
+		t.Fatalf("request returned %v", code)
+	}
+
+	if !d.force.Load() {
+		t.Error("rebuild not forced")
+	}
+
+	select {
+	case <-wake:
+	default:
+		t.Error("poll loop wasn't woken up")
+	}
+}
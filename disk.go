@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkOutputDir returns an error if builds can't be written to dir, e.g.
+// because its file system isn't mounted or is read-only. A missing dir is
+// created if its parent exists, like the subdirectories for branches.
+func checkOutputDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		_, err = os.Stat(filepath.Dir(dir))
+		if err != nil {
+			return fmt.Errorf("output directory %v and its parent don't exist, check that the file system is mounted: %w", dir, err)
+		}
+
+		err = os.Mkdir(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("creating output directory failed: %w", err)
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("output directory %v is not accessible: %w", dir, err)
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("output directory %v is not a directory", dir)
+	}
+
+	f, err := ioutil.TempFile(dir, ".write-test-")
+	if err != nil {
+		return fmt.Errorf("output directory %v is not writable, check that the file system is mounted read-write: %w", dir, err)
+	}
+
+	_ = f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// checkFreeSpace returns an error if less than cfg.MinFree bytes are
+// available for outputdir. If cfg.PruneLowSpace is set, the oldest builds are
+// removed until enough space is available or only the newest one is left.
+func checkFreeSpace(outputdir string, cfg Config) error {
+	if cfg.MinFree <= 0 {
+		return nil
+	}
+
+	err := os.MkdirAll(outputdir, 0755)
+	if err != nil {
+		return fmt.Errorf("mkdir output dir failed: %w", err)
+	}
+
+	free, err := availableSpace(outputdir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("checking free space failed: %w", err)
+	}
+
+	freeSpace.Set(float64(free))
+
+	if free >= cfg.MinFree || !cfg.PruneLowSpace || cfg.S3 != nil {
+		return errLowSpace(outputdir, free, cfg.MinFree)
+	}
+
+	for keep := countBuilds(outputdir) - 1; keep >= 1 && free < cfg.MinFree; keep-- {
+		slog.Warn("low disk space, pruning old builds", "dir", outputdir, "free", free, "keep", keep)
+
+		err = pruneAndIndex(outputdir, keep, cfg.Index)
+		if err != nil {
+			return fmt.Errorf("pruning old builds failed: %w", err)
+		}
+
+		free, err = availableSpace(outputdir)
+		if err != nil {
+			return fmt.Errorf("checking free space failed: %w", err)
+		}
+
+		freeSpace.Set(float64(free))
+	}
+
+	return errLowSpace(outputdir, free, cfg.MinFree)
+}
+
+// errLowSpace returns a DiskFullError if free is less than required.
+func errLowSpace(dir string, free, required int64) error {
+	if free >= required {
+		return nil
+	}
+
+	return DiskFullError{Dir: dir, Free: free, Required: required}
+}
+
+// countBuilds returns the number of version directories in outputdir.
+func countBuilds(outputdir string) int {
+	entries, err := ioutil.ReadDir(outputdir)
+	if err != nil {
+		return 0
+	}
+
+	n := 0
+
+	for _, fi := range entries {
+		if fi.IsDir() && strings.HasPrefix(fi.Name(), "restic-") {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// availableSpace returns the number of bytes available to unprivileged users
+// on the file system containing dir.
+func availableSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
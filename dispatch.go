@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dispatcher hands out the targets of a build to the workers and collects the
+// results.
+type Dispatcher interface {
+	// Next returns the next target to build, ok is false if there are no
+	// targets left.
+	Next() (target BuildTarget, ok bool)
+
+	// Report records the result of building a target.
+	Report(res buildResult)
+}
+
+// chanDispatcher distributes the targets sent over a channel to the workers
+// within this process.
+type chanDispatcher struct {
+	ch     <-chan BuildTarget
+	report func(buildResult)
+}
+
+func (d *chanDispatcher) Next() (BuildTarget, bool) {
+	target, ok := <-d.ch
+	return target, ok
+}
+
+func (d *chanDispatcher) Report(res buildResult) {
+	d.report(res)
+}
+
+// leaseTimeout is the time after which a target taken by a remote worker is
+// handed out again if no result has been reported.
+const leaseTimeout = 30 * time.Minute
+
+// jobQueue is a Dispatcher which also hands out targets to other builder
+// instances (started with -worker) via HTTP. The workers must write to the
+// same output directory, e.g. on a network file system.
+type jobQueue struct {
+	token string
+
+	mu      sync.Mutex
+	active  bool
+	batch   job
+	targets []BuildTarget
+	pending []BuildTarget
+	leased  map[string]time.Time
+	report  func(buildResult)
+
+	// reporting contains the leased targets whose result is being recorded,
+	// they stay leased until report returns so that the build does not
+	// finish in the meantime
+	reporting map[string]bool
+}
+
+func newJobQueue(token string) *jobQueue {
+	return &jobQueue{token: token}
+}
+
+// start makes the targets of a new build available.
+func (q *jobQueue) start(batch job, targets []BuildTarget, report func(buildResult)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.active = true
+	q.batch = batch
+	q.targets = targets
+	q.pending = append([]BuildTarget(nil), targets...)
+	q.leased = make(map[string]time.Time)
+	q.reporting = make(map[string]bool)
+	q.report = report
+}
+
+// stop ends the current build, results reported afterwards are ignored.
+func (q *jobQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.active = false
+	q.pending = nil
+	q.leased = nil
+	q.reporting = nil
+}
+
+// take returns the next target. If all targets have been handed out, done
+// reports whether all results are in.
+func (q *jobQueue) take() (target BuildTarget, ok bool, done bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.active {
+		return BuildTarget{}, false, true
+	}
+
+	// hand out targets again whose worker seems to be gone
+	for name, t := range q.leased {
+		if time.Since(t) > leaseTimeout && !q.reporting[name] {
+			slog.Warn("no result from remote worker, requeueing target", "target", name)
+			delete(q.leased, name)
+
+			for _, target := range q.targets {
+				if target.String() == name {
+					q.pending = append(q.pending, target)
+				}
+			}
+		}
+	}
+
+	if len(q.pending) == 0 {
+		return BuildTarget{}, false, len(q.leased) == 0
+	}
+
+	target = q.pending[0]
+	q.pending = q.pending[1:]
+	q.leased[target.String()] = time.Now()
+
+	return target, true, false
+}
+
+// Next returns the next target for a local worker. While remote workers are
+// still busy, it waits so that targets can be picked up again if a remote
+// worker fails to report.
+func (q *jobQueue) Next() (BuildTarget, bool) {
+	for {
+		target, ok, done := q.take()
+		if ok {
+			return target, true
+		}
+
+		if done {
+			return BuildTarget{}, false
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+func (q *jobQueue) Report(res buildResult) {
+	name := res.Target.String()
+
+	q.mu.Lock()
+
+	if !q.active {
+		q.mu.Unlock()
+		return
+	}
+
+	if _, ok := q.leased[name]; !ok || q.reporting[name] {
+		// duplicate or unknown result
+		q.mu.Unlock()
+		return
+	}
+
+	q.reporting[name] = true
+	leased, reporting, report := q.leased, q.reporting, q.report
+	q.mu.Unlock()
+
+	report(res)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(leased, name)
+	delete(reporting, name)
+}
+
+// leasedJob returns the job of the current build if target has been handed out
+// and its result hasn't been reported yet.
+func (q *jobQueue) leasedJob(target BuildTarget) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name := target.String()
+	if _, ok := q.leased[name]; !q.active || !ok || q.reporting[name] {
+		return job{}, false
+	}
+
+	return q.batch, true
+}
+
+// checkArtifact returns the artifact reported by a remote worker for target,
+// after checking that it has the file name expected by batch. The size and the
+// checksum are taken from the file in the build directory, not from the
+// report.
+func checkArtifact(batch job, target BuildTarget, a Artifact) (Artifact, error) {
+	expected, ok := batch.Filenames[target.String()]
+	if !ok {
+		return Artifact{}, fmt.Errorf("unknown target %v", target)
+	}
+
+	expected += batch.Compress.Ext()
+
+	if a.Filename != expected || !validArtifactName(a.Filename) {
+		return Artifact{}, fmt.Errorf("unexpected file name %q for %v", a.Filename, target)
+	}
+
+	filename := filepath.Join(batch.Dir, filepath.FromSlash(a.Filename))
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return Artifact{}, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return Artifact{}, fmt.Errorf("%v is not a regular file", a.Filename)
+	}
+
+	hash, err := sha256File(filename)
+	if err != nil {
+		return Artifact{}, fmt.Errorf("checksum for %v failed: %w", a.Filename, err)
+	}
+
+	if a.SHA256 != hash {
+		return Artifact{}, fmt.Errorf("checksum for %v does not match the file", a.Filename)
+	}
+
+	a.OS, a.Arch, a.Variant, a.Profile = target.OS, target.Arch, target.Variant, target.Profile
+	a.Size = fi.Size()
+
+	return a, nil
+}
+
+// validArtifactName reports whether name is the name of a file in the version
+// directory, or in the subdirectory of a profile.
+func validArtifactName(name string) bool {
+	parts := strings.Split(name, "/")
+	if len(parts) > 2 || strings.Contains(name, `\`) {
+		return false
+	}
+
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// jobReport is sent by a remote worker after building a target.
+type jobReport struct {
+	Target   BuildTarget `json:"target"`
+	Artifact Artifact    `json:"artifact"`
+	Duration float64     `json:"duration"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// ServeHTTP implements the endpoints /queue/next, which returns the next job
+// or 204 if none is available, and /queue/report, which receives a jobReport.
+func (q *jobQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, q.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/queue/") {
+	case "next":
+		target, ok, _ := q.take()
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		q.mu.Lock()
+		j := q.batch
+		q.mu.Unlock()
+
+		j.Target = target
+		slog.Info("remote worker takes target", "remote", r.RemoteAddr, "target", target)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(j)
+
+	case "report":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var rep jobReport
+
+		err := json.NewDecoder(r.Body).Decode(&rep)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var buildErr error
+		if rep.Error != "" {
+			buildErr = BuildError{Target: rep.Target, Err: fmt.Errorf("remote worker %v: %v", r.RemoteAddr, rep.Error)}
+			rep.Artifact = Artifact{}
+		}
+
+		batch, ok := q.leasedJob(rep.Target)
+		if !ok {
+			http.Error(w, "target is not leased", http.StatusConflict)
+			return
+		}
+
+		if buildErr == nil {
+			rep.Artifact, err = checkArtifact(batch, rep.Target, rep.Artifact)
+			if err != nil {
+				slog.Warn("rejecting result from remote worker", "remote", r.RemoteAddr, "target", rep.Target, "err", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		q.Report(buildResult{
+			Target:   rep.Target,
+			Artifact: rep.Artifact,
+			Duration: time.Duration(rep.Duration * float64(time.Second)),
+			Err:      buildErr,
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// runWorker takes jobs from the builder at coordinator and builds them in the
+// clone of repo until ctx is canceled.
+func runWorker(ctx context.Context, coordinator, token string, repo Repo) {
+	client := &http.Client{Timeout: time.Minute}
+	coordinator = strings.TrimSuffix(coordinator, "/")
+
+	// the targets are compiled with the go command of the worker
+	goVer, err := goVersion()
+	if err != nil {
+		slog.Warn("unable to record the Go version", "err", err)
+	}
+
+	for ctx.Err() == nil {
+		j, ok, err := takeJob(ctx, client, coordinator, token)
+		if err != nil {
+			slog.Warn("taking job failed", "err", err)
+		}
+
+		if !ok {
+			select {
+			case <-time.After(10 * time.Second):
+			case <-ctx.Done():
+			}
+
+			continue
+		}
+
+		slog.Info("building job", "version", j.Version, "target", j.Target)
+
+		j.GoVersion = goVer
+
+		rep := jobReport{Target: j.Target}
+
+		err = fetch(ctx, repo.Remote, repo.Dir)
+		if err == nil {
+			err = checkout(ctx, repo.Dir, j.Commit)
+		}
+
+		if err == nil {
+			start := time.Now()
+			rep.Artifact, err = buildTarget(ctx, repo.Dir, j)
+			rep.Duration = time.Since(start).Seconds()
+		}
+
+		if ctx.Err() != nil {
+			// don't report, the coordinator will hand out the target again
+			break
+		}
+
+		if err != nil {
+			rep.Error = err.Error()
+		}
+
+		err = sendReport(client, coordinator, token, rep)
+		if err != nil {
+			slog.Error("reporting result failed", "err", err)
+		}
+	}
+}
+
+func takeJob(ctx context.Context, client *http.Client, coordinator, token string) (j job, ok bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, coordinator+"/queue/next", nil)
+	if err != nil {
+		return job{}, false, err
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return job{}, false, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent {
+		return job{}, false, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		return job{}, false, fmt.Errorf("coordinator returned status %v", res.Status)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&j)
+	if err != nil {
+		return job{}, false, err
+	}
+
+	return j, true, nil
+}
+
+func sendReport(client *http.Client, coordinator, token string, rep jobReport) error {
+	buf, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, coordinator+"/queue/report", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("coordinator returned status %v", res.Status)
+	}
+
+	return nil
+}
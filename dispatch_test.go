@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidArtifactName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"restic_v0.16.0_linux_amd64", true},
+		{"restic_v0.16.0_linux_amd64.bz2", true},
+		{"debug/restic_v0.16.0_linux_amd64", true},
+		{"", false},
+		{"..", false},
+		{"../restic", false},
+		{"debug/../../restic", false},
+		{"/etc/passwd", false},
+		{"debug/", false},
+		{"./restic", false},
+		{`..\restic`, false},
+		{"a/b/restic", false},
+	}
+
+	for _, test := range tests {
+		if got := validArtifactName(test.name); got != test.valid {
+			t.Errorf("validArtifactName(%q) = %v, want %v", test.name, got, test.valid)
+		}
+	}
+}
+
+// newTestBatch returns a job for linux/amd64, whose binary has already been
+// written to the build directory, and the checksum of the binary.
+func newTestBatch(t *testing.T) (job, string) {
+	dir := t.TempDir()
+
+	batch := job{
+		Dir:       dir,
+		Compress:  CompressBzip2,
+		Filenames: map[string]string{"linux/amd64": "restic_linux_amd64"},
+	}
+
+	filename := filepath.Join(dir, "restic_linux_amd64.bz2")
+
+	err := ioutil.WriteFile(filename, []byte("binary"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := sha256File(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return batch, hash
+}
+
+func TestCheckArtifact(t *testing.T) {
+	batch, hash := newTestBatch(t)
+	target := BuildTarget{OS: "linux", Arch: "amd64"}
+
+	err := os.Mkdir(filepath.Join(batch.Dir, "restic_linux_arm64.bz2"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch.Filenames["linux/arm64"] = "restic_linux_arm64"
+
+	tests := []struct {
+		name     string
+		target   BuildTarget
+		artifact Artifact
+
+		// err is contained in the error, if empty the artifact is valid
+		err string
+	}{
+		{
+			name:     "valid",
+			target:   target,
+			artifact: Artifact{Filename: "restic_linux_amd64.bz2", SHA256: hash, Size: 1},
+		},
+		{
+			name:     "unknown target",
+			target:   BuildTarget{OS: "windows", Arch: "amd64"},
+			artifact: Artifact{Filename: "restic_linux_amd64.bz2", SHA256: hash},
+			err:      "unknown target",
+		},
+		{
+			name:     "other file",
+			target:   target,
+			artifact: Artifact{Filename: "../../etc/passwd", SHA256: hash},
+			err:      "unexpected file name",
+		},
+		{
+			name:     "missing extension",
+			target:   target,
+			artifact: Artifact{Filename: "restic_linux_amd64", SHA256: hash},
+			err:      "unexpected file name",
+		},
+		{
+			name:     "wrong checksum",
+			target:   target,
+			artifact: Artifact{Filename: "restic_linux_amd64.bz2", SHA256: strings.Repeat("0", 64)},
+			err:      "does not match",
+		},
+		{
+			name:     "directory",
+			target:   BuildTarget{OS: "linux", Arch: "arm64"},
+			artifact: Artifact{Filename: "restic_linux_arm64.bz2", SHA256: hash},
+			err:      "not a regular file",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := checkArtifact(batch, test.target, test.artifact)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the size and the target come from the file, not the report
+			if a.Size != int64(len("binary")) {
+				t.Errorf("size is %d, want %d", a.Size, len("binary"))
+			}
+
+			if a.OS != test.target.OS || a.Arch != test.target.Arch {
+				t.Errorf("artifact is for %v/%v, want %v", a.OS, a.Arch, test.target)
+			}
+		})
+	}
+}
+
+func TestQueueReport(t *testing.T) {
+	batch, hash := newTestBatch(t)
+	target := BuildTarget{OS: "linux", Arch: "amd64"}
+
+	var reported []buildResult
+
+	q := newJobQueue("secret")
+	q.start(batch, []BuildTarget{target}, func(res buildResult) {
+		reported = append(reported, res)
+	})
+
+	request := func(path, token string, rep *jobReport) int {
+		var body io.Reader = http.NoBody
+		if rep != nil {
+			buf, err := json.Marshal(rep)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body = bytes.NewReader(buf)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, path, body)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rec := httptest.NewRecorder()
+		q.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	valid := &jobReport{
+		Target:   target,
+		Artifact: Artifact{Filename: "restic_linux_amd64.bz2", SHA256: hash},
+	}
+
+	if code := request("/queue/report", "secret", valid); code != http.StatusConflict {
+		t.Errorf("report for a target which is not leased returned %v", code)
+	}
+
+	for _, token := range []string{"wrong", "secre", "secrets", ""} {
+		if code := request("/queue/next", token, nil); code != http.StatusUnauthorized {
+			t.Errorf("request with the token %q returned %v", token, code)
+		}
+	}
+
+	if code := request("/queue/next", "secret", nil); code != http.StatusOK {
+		t.Fatalf("taking the target returned %v", code)
+	}
+
+	invalid := &jobReport{
+		Target:   target,
+		Artifact: Artifact{Filename: "../../restic", SHA256: hash},
+	}
+
+	if code := request("/queue/report", "secret", invalid); code != http.StatusBadRequest {
+		t.Errorf("report for another file returned %v", code)
+	}
+
+	if code := request("/queue/report", "secret", valid); code != http.StatusOK {
+		t.Errorf("valid report returned %v", code)
+	}
+
+	// the target is no longer leased
+	if code := request("/queue/report", "secret", valid); code != http.StatusConflict {
+		t.Errorf("duplicate report returned %v", code)
+	}
+
+	if len(reported) != 1 {
+		t.Fatalf("%d results reported, want 1", len(reported))
+	}
+
+	if reported[0].Err != nil || reported[0].Artifact.Size != int64(len("binary")) {
+		t.Errorf("unexpected result %+v", reported[0])
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CloneError is returned if cloning the repository failed.
+type CloneError struct {
+	URL string
+	Err error
+}
+
+func (e CloneError) Error() string {
+	return fmt.Sprintf("cloning %v failed: %v", e.URL, e.Err)
+}
+
+func (e CloneError) Unwrap() error { return e.Err }
+
+// UpdateError is returned if fetching from or pulling the remote repository
+// failed.
+type UpdateError struct {
+	Err error
+}
+
+func (e UpdateError) Error() string {
+	return fmt.Sprintf("updating the repository failed: %v", e.Err)
+}
+
+func (e UpdateError) Unwrap() error { return e.Err }
+
+// BuildError is returned if building a target failed, from compiling it to
+// computing the checksum of the artifact.
+type BuildError struct {
+	Target BuildTarget
+	Err    error
+}
+
+func (e BuildError) Error() string { return e.Err.Error() }
+func (e BuildError) Unwrap() error { return e.Err }
+
+// PublishError is returned if a complete build couldn't be published.
+type PublishError struct {
+	Version string
+	Err     error
+}
+
+func (e PublishError) Error() string {
+	return fmt.Sprintf("publishing %v failed: %v", e.Version, e.Err)
+}
+
+func (e PublishError) Unwrap() error { return e.Err }
+
+// DiskFullError is returned if less than the required space is available for
+// the output directory, so that a build isn't started.
+type DiskFullError struct {
+	Dir      string
+	Free     int64
+	Required int64
+}
+
+func (e DiskFullError) Error() string {
+	return fmt.Sprintf("only %v available for %v, at least %v are required", formatSize(e.Free), e.Dir, formatSize(e.Required))
+}
+
+// Stages of the work reported by failureStage.
+const (
+	stageClone   = "clone"
+	stageUpdate  = "update"
+	stageBuild   = "build"
+	stagePublish = "publish"
+)
+
+// failureStage returns the stage in which err happened, or the empty string
+// if it is none of the typed errors above.
+func failureStage(err error) string {
+	switch {
+	case errors.As(err, new(CloneError)):
+		return stageClone
+	case errors.As(err, new(UpdateError)):
+		return stageUpdate
+	case errors.As(err, new(PublishError)):
+		return stagePublish
+	case errors.As(err, new(BuildError)):
+		return stageBuild
+	}
+
+	return ""
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestFailureStage(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		err   error
+		stage string
+	}{
+		{nil, ""},
+		{errFailed, ""},
+		{CloneError{URL: "https://example.com/repo", Err: errFailed}, stageClone},
+		{fmt.Errorf("polling failed: %w", UpdateError{Err: errFailed}), stageUpdate},
+		{fmt.Errorf("build failed: %w", BuildError{Target: BuildTarget{OS: "linux", Arch: "amd64"}, Err: errFailed}), stageBuild},
+		{fmt.Errorf("build failed: %w", PublishError{Version: "0.1.0", Err: errFailed}), stagePublish},
+		{DiskFullError{Dir: "/out", Free: 1, Required: 2}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			stage := failureStage(test.err)
+			if stage != test.stage {
+				t.Errorf("failureStage(%v) returned %q, want %q", test.err, stage, test.stage)
+			}
+
+			if test.err != nil && test.stage != "" && !errors.Is(test.err, errFailed) {
+				t.Errorf("%v doesn't wrap the original error", test.err)
+			}
+		})
+	}
+}
+
+func TestErrorsAs(t *testing.T) {
+	errFailed := errors.New("failed")
+	target := BuildTarget{OS: "linux", Arch: "amd64"}
+
+	err := fmt.Errorf("build failed: %w", BuildError{Target: target, Err: errFailed})
+
+	var buildErr BuildError
+	if !errors.As(err, &buildErr) || buildErr.Target.String() != target.String() {
+		t.Errorf("BuildError not found in %v, got %+v", err, buildErr)
+	}
+
+	err = fmt.Errorf("build failed: %w", PublishError{Version: "0.1.0", Err: errFailed})
+
+	var publishErr PublishError
+	if !errors.As(err, &publishErr) || publishErr.Version != "0.1.0" {
+		t.Errorf("PublishError not found in %v, got %+v", err, publishErr)
+	}
+
+	err = fmt.Errorf("polling failed: %w", CloneError{URL: "https://example.com/repo", Err: errFailed})
+
+	var cloneErr CloneError
+	if !errors.As(err, &cloneErr) || cloneErr.URL != "https://example.com/repo" {
+		t.Errorf("CloneError not found in %v, got %+v", err, cloneErr)
+	}
+
+	err = fmt.Errorf("polling failed: %w", UpdateError{Err: errFailed})
+	if !errors.As(err, new(UpdateError)) {
+		t.Errorf("UpdateError not found in %v", err)
+	}
+
+	err = fmt.Errorf("build failed: %w", errLowSpace("/out", 1<<20, 1<<30))
+
+	var diskErr DiskFullError
+	if !errors.As(err, &diskErr) || diskErr.Dir != "/out" || diskErr.Free != 1<<20 {
+		t.Errorf("DiskFullError not found in %v, got %+v", err, diskErr)
+	}
+
+	if errLowSpace("/out", 1<<30, 1<<30) != nil {
+		t.Error("errLowSpace returned an error with enough free space")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Forge is the service hosting the repository, it determines the links to
+// its web interface used in notifications.
+type Forge interface {
+	// CloneURL returns the URL the repository is cloned from.
+	CloneURL() string
+
+	// CommitURL returns the link to the commit sha in the web interface,
+	// or the empty string if there is none.
+	CommitURL(sha string) string
+}
+
+// Types of forges, selected with -forge.
+const (
+	forgeGitHub = "github"
+	forgeGitLab = "gitlab"
+	forgeGitea  = "gitea"
+)
+
+// commitPaths maps the types of forges to the path of commits below the web
+// page of a repository.
+var commitPaths = map[string]string{
+	forgeGitHub: "/commit/",
+	forgeGitLab: "/-/commit/",
+	forgeGitea:  "/commit/",
+}
+
+// forgeHosts lists the hosts of public instances which are detected if no
+// type is configured. Other hosts default to GitHub.
+var forgeHosts = map[string]string{
+	"gitlab.com":   forgeGitLab,
+	"codeberg.org": forgeGitea,
+	"gitea.com":    forgeGitea,
+}
+
+// validForge returns an error if kind isn't empty and not a type of forge.
+func validForge(kind string) error {
+	if _, ok := commitPaths[kind]; kind != "" && !ok {
+		return fmt.Errorf("unknown forge %q, valid are github, gitlab and gitea", kind)
+	}
+
+	return nil
+}
+
+// webForge is a forge whose web interface has the same paths as the
+// repository URL, which is the case for GitHub, GitLab and Gitea.
+type webForge struct {
+	url string
+
+	// web is the web page of the repository, empty if the URL isn't
+	// hosted on a web server, e.g. a local path.
+	web        string
+	commitPath string
+}
+
+// newForge returns the forge for the repository at remote, of the type kind
+// or detected from the host if kind is empty.
+func newForge(kind, remote string) Forge {
+	host, path := splitRemote(remote)
+
+	if kind == "" {
+		kind = forgeHosts[host]
+	}
+
+	if kind == "" {
+		kind = forgeGitHub
+	}
+
+	f := webForge{url: remote, commitPath: commitPaths[kind]}
+
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if host != "" && path != "" {
+		f.web = "https://" + host + "/" + path
+	}
+
+	return f
+}
+
+// splitRemote returns the host and path of the URL remote, the host is empty
+// for local repositories.
+func splitRemote(remote string) (host, path string) {
+	// scp-like SSH addresses, e.g. git@github.com:restic/restic.git
+	if !strings.Contains(remote, "://") {
+		userHost, path, ok := strings.Cut(remote, ":")
+		// a colon after a slash or a drive letter is part of a path
+		if !ok || strings.Contains(userHost, "/") || len(userHost) < 2 {
+			return "", ""
+		}
+
+		if i := strings.LastIndex(userHost, "@"); i >= 0 {
+			userHost = userHost[i+1:]
+		}
+
+		return userHost, path
+	}
+
+	u, err := url.Parse(remote)
+	if err != nil {
+		return "", ""
+	}
+
+	switch u.Scheme {
+	case "https", "http":
+		return u.Host, u.Path
+	case "ssh", "git":
+		// the web interface doesn't use the port of the git server
+		return u.Hostname(), u.Path
+	}
+
+	return "", ""
+}
+
+func (f webForge) CloneURL() string {
+	return f.url
+}
+
+func (f webForge) CommitURL(sha string) string {
+	if f.web == "" {
+		return ""
+	}
+
+	return f.web + f.commitPath + sha
+}
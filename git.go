@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Git runs the git commands of the poll loop, so that it can be driven without
+// a clone of the repository or access to the network. Only build itself, which
+// compiles the checked out source, runs git directly.
+type Git interface {
+	// Clone clones remote into dir.
+	Clone(ctx context.Context, remote Remote, dir string) error
+
+	// Pull updates the checked out branch in dir from remote, Fetch only
+	// updates the remote-tracking branches, FetchTags fetches all tags.
+	Pull(ctx context.Context, remote Remote, dir string) error
+	Fetch(ctx context.Context, remote Remote, dir string) error
+	FetchTags(ctx context.Context, remote Remote, dir string) error
+
+	// RevParse returns the commit ID rev resolves to in dir.
+	RevParse(ctx context.Context, dir, rev string) (string, error)
+
+	// Describe returns the version string for commit in dir, the empty
+	// commit denotes the working tree.
+	Describe(ctx context.Context, dir, commit string) (string, error)
+
+	// Checkout switches the working tree to rev with a detached HEAD,
+	// SwitchBranch checks out branch. CurrentBranch returns the name of
+	// the checked out branch, it fails if HEAD is detached.
+	Checkout(ctx context.Context, dir, rev string) error
+	SwitchBranch(ctx context.Context, dir, branch string) error
+	CurrentBranch(ctx context.Context, dir string) (string, error)
+
+	// ChangedFiles returns the names of the files which differ between
+	// the commits old and new.
+	ChangedFiles(ctx context.Context, dir, old, new string) ([]string, error)
+
+	// ListTags returns the tags matching the glob pattern, oldest first.
+	// PreviousTag returns the newest one which is an ancestor of tag,
+	// LatestTag the newest tag reachable from commit.
+	ListTags(ctx context.Context, dir, pattern string) ([]string, error)
+	PreviousTag(ctx context.Context, dir, tag, pattern string) (string, error)
+	LatestTag(ctx context.Context, dir, commit string) (string, error)
+
+	// Log returns at most max commits in old..new, see shortlog.
+	Log(ctx context.Context, dir, old, new string, max int) (commits []string, more bool, err error)
+
+	// CommitDate returns the committer date of commit.
+	CommitDate(ctx context.Context, dir, commit string) (time.Time, error)
+}
+
+// execGit runs the git binary found in $PATH.
+type execGit struct{}
+
+func (execGit) Clone(ctx context.Context, remote Remote, dir string) error {
+	return clone(ctx, remote, dir)
+}
+
+func (execGit) Pull(ctx context.Context, remote Remote, dir string) error {
+	return update(ctx, remote, dir)
+}
+
+func (execGit) Fetch(ctx context.Context, remote Remote, dir string) error {
+	return fetch(ctx, remote, dir)
+}
+
+func (execGit) FetchTags(ctx context.Context, remote Remote, dir string) error {
+	return fetchTags(ctx, remote, dir)
+}
+
+func (execGit) RevParse(ctx context.Context, dir, rev string) (string, error) {
+	return commitID(ctx, dir, rev)
+}
+
+func (execGit) Describe(ctx context.Context, dir, commit string) (string, error) {
+	if commit == "" {
+		return getVersionFromGit(ctx, dir)
+	}
+
+	return describeCommit(ctx, dir, commit)
+}
+
+func (execGit) Checkout(ctx context.Context, dir, rev string) error {
+	return checkout(ctx, dir, rev)
+}
+
+func (execGit) SwitchBranch(ctx context.Context, dir, branch string) error {
+	return switchBranch(ctx, dir, branch)
+}
+
+func (execGit) CurrentBranch(ctx context.Context, dir string) (string, error) {
+	return currentBranch(ctx, dir)
+}
+
+func (execGit) ChangedFiles(ctx context.Context, dir, old, new string) ([]string, error) {
+	return changedFiles(ctx, dir, old, new)
+}
+
+func (execGit) ListTags(ctx context.Context, dir, pattern string) ([]string, error) {
+	return listTags(ctx, dir, pattern)
+}
+
+func (execGit) PreviousTag(ctx context.Context, dir, tag, pattern string) (string, error) {
+	return previousTag(ctx, dir, tag, pattern)
+}
+
+func (execGit) LatestTag(ctx context.Context, dir, commit string) (string, error) {
+	return latestTag(ctx, dir, commit)
+}
+
+func (execGit) Log(ctx context.Context, dir, old, new string, max int) ([]string, bool, error) {
+	return shortlog(ctx, dir, old, new, max)
+}
+
+func (execGit) CommitDate(ctx context.Context, dir, commit string) (time.Time, error) {
+	return commitDate(ctx, dir, commit)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeGit implements Git for a repository which only exists in memory.
+type fakeGit struct {
+	mu sync.Mutex
+
+	// refs maps revisions, e.g. "origin/master" or "HEAD", to commits.
+	refs map[string]string
+
+	// changed maps "old..new" to the files changed between the commits.
+	changed map[string][]string
+
+	// tags lists the tags, oldest first.
+	tags []string
+
+	// fetchErr is returned by Pull, Fetch and FetchTags.
+	fetchErr error
+
+	// calls records the names of the methods called.
+	calls []string
+}
+
+func newFakeGit(refs map[string]string) *fakeGit {
+	return &fakeGit{refs: refs, changed: make(map[string][]string)}
+}
+
+func (g *fakeGit) record(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.calls = append(g.calls, name)
+}
+
+// called returns how often the method name was called.
+func (g *fakeGit) called(name string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n := 0
+
+	for _, call := range g.calls {
+		if call == name {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (g *fakeGit) Clone(context.Context, Remote, string) error {
+	g.record("Clone")
+	return nil
+}
+
+func (g *fakeGit) Pull(context.Context, Remote, string) error {
+	g.record("Pull")
+	return g.fetchErr
+}
+
+func (g *fakeGit) Fetch(context.Context, Remote, string) error {
+	g.record("Fetch")
+	return g.fetchErr
+}
+
+func (g *fakeGit) FetchTags(context.Context, Remote, string) error {
+	g.record("FetchTags")
+	return g.fetchErr
+}
+
+func (g *fakeGit) RevParse(_ context.Context, _, rev string) (string, error) {
+	g.record("RevParse")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	commit, ok := g.refs[rev]
+	if ok {
+		return commit, nil
+	}
+
+	for _, commit := range g.refs {
+		if commit == rev {
+			return commit, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown revision %v", rev)
+}
+
+func (g *fakeGit) Describe(ctx context.Context, dir, commit string) (string, error) {
+	g.record("Describe")
+
+	if commit == "" {
+		commit = "HEAD"
+	}
+
+	id, err := g.RevParse(ctx, dir, commit)
+	if err != nil {
+		return "", err
+	}
+
+	return "v0.1.0-1-g" + id[:7], nil
+}
+
+func (g *fakeGit) Checkout(_ context.Context, _, rev string) error {
+	g.record("Checkout")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	commit, ok := g.refs[rev]
+	if !ok {
+		commit = rev
+	}
+
+	g.refs["HEAD"] = commit
+
+	return nil
+}
+
+func (g *fakeGit) SwitchBranch(_ context.Context, _, branch string) error {
+	g.record("SwitchBranch")
+	return nil
+}
+
+func (g *fakeGit) CurrentBranch(context.Context, string) (string, error) {
+	g.record("CurrentBranch")
+	return "master", nil
+}
+
+func (g *fakeGit) ChangedFiles(_ context.Context, _, old, new string) ([]string, error) {
+	g.record("ChangedFiles")
+
+	files, ok := g.changed[old+".."+new]
+	if !ok {
+		return nil, fmt.Errorf("unknown commits %v..%v", old, new)
+	}
+
+	return files, nil
+}
+
+func (g *fakeGit) ListTags(_ context.Context, _, pattern string) ([]string, error) {
+	g.record("ListTags")
+
+	var tags []string
+
+	for _, tag := range g.tags {
+		if strings.HasPrefix(tag, strings.TrimSuffix(pattern, "*")) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags, nil
+}
+
+func (g *fakeGit) PreviousTag(context.Context, string, string, string) (string, error) {
+	g.record("PreviousTag")
+	return "", fmt.Errorf("no previous tag")
+}
+
+func (g *fakeGit) LatestTag(context.Context, string, string) (string, error) {
+	g.record("LatestTag")
+	return "", fmt.Errorf("no tag")
+}
+
+func (g *fakeGit) Log(context.Context, string, string, string, int) ([]string, bool, error) {
+	g.record("Log")
+	return nil, false, nil
+}
+
+func (g *fakeGit) CommitDate(context.Context, string, string) (time.Time, error) {
+	g.record("CommitDate")
+	return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// progressLine matches the progress reports printed by git, e.g.
+// "Receiving objects:  45% (450/1000), 1.20 MiB | 600.00 KiB/s".
+var progressLine = regexp.MustCompile(`^(?:remote: )?([A-Za-z ]+):\s+(\d+)% \((\d+)/(\d+)\)(?:, ([\d.]+ [KMG]?i?B)(?: \| ([\d.]+ [KMG]?i?B/s))?)?`)
+
+// progressInterval is the time between two progress events of a phase.
+const progressInterval = 5 * time.Second
+
+// progressLogger turns git's progress output into log events. git redraws the
+// progress of a phase in place with carriage returns, it is logged every
+// progressInterval and when the phase is complete. Other lines are passed on
+// to stderr.
+type progressLogger struct {
+	log *slog.Logger
+	buf []byte
+
+	phase    string
+	complete bool
+	last     time.Time
+}
+
+func newProgressLogger(log *slog.Logger) *progressLogger {
+	return &progressLogger{log: log}
+}
+
+func (p *progressLogger) Write(buf []byte) (int, error) {
+	p.buf = append(p.buf, buf...)
+
+	for {
+		i := bytes.IndexAny(p.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+
+		line := string(bytes.TrimSpace(p.buf[:i]))
+		p.buf = p.buf[i+1:]
+
+		if line != "" {
+			p.line(line)
+		}
+	}
+
+	return len(buf), nil
+}
+
+func (p *progressLogger) line(line string) {
+	m := progressLine.FindStringSubmatch(line)
+	if m == nil {
+		_, _ = os.Stderr.WriteString(line + "\n")
+		return
+	}
+
+	percent, _ := strconv.Atoi(m[2])
+
+	if m[1] != p.phase {
+		p.phase, p.complete, p.last = m[1], false, time.Now()
+	}
+
+	switch {
+	case p.complete:
+		// the last line of a phase is repeated with ", done." appended
+		return
+	case percent == 100:
+		p.complete = true
+	case time.Since(p.last) < progressInterval:
+		return
+	}
+
+	p.last = time.Now()
+
+	fields := []any{"phase", m[1], "percent", percent, "done", m[3], "total", m[4]}
+	if m[5] != "" {
+		fields = append(fields, "received", m[5])
+	}
+
+	if m[6] != "" {
+		fields = append(fields, "rate", m[6])
+	}
+
+	p.log.Info("git progress", fields...)
+}
+
+// dirSize returns the size of all files below dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		size += fi.Size()
+		return nil
+	})
+
+	return size, err
+}
+
+// logCloneDone reports how long cloning into dir took and how large the
+// repository is.
+func logCloneDone(dir string, start time.Time) {
+	size, err := dirSize(filepath.Join(dir, ".git"))
+	if err != nil {
+		slog.Warn("determining the size of the clone failed", "dir", dir, "err", err)
+	}
+
+	slog.Info("cloned repo", "dir", dir, "duration", time.Since(start).Round(time.Millisecond), "size", formatSize(size))
+}
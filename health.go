@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// health returns the problems which indicate that the builder is stuck: the
+// poll loop hasn't finished a successful poll within threshold, a branch has
+// new commits but failed to build them for longer than threshold, or its new
+// commits haven't been built for longer than that, e.g. because the output
+// directory is unusable. A branch whose last build succeeded and which has no
+// pending commits is healthy, no matter how long ago that was.
+func (s *Status) health(threshold time.Duration) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var problems []string
+
+	lastPoll := s.lastPoll
+	if lastPoll.IsZero() {
+		lastPoll = s.started
+	}
+
+	if time.Since(lastPoll) > threshold {
+		problems = append(problems, fmt.Sprintf("no poll succeeded since %v", lastPoll.Format(time.RFC3339)))
+	}
+
+	// the keys are sorted, so that the problems are listed in a stable order
+	keys := make([]string, 0, len(s.branches))
+	for key := range s.branches {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		bs := s.branches[key]
+		name := buildName(bs.Repo, bs.Branch)
+
+		if bs.FailingSince != nil && time.Since(*bs.FailingSince) > threshold {
+			problems = append(problems, fmt.Sprintf("%v failing since %v: %v", name, bs.FailingSince.Format(time.RFC3339), bs.LastError))
+		}
+
+		if bs.PendingSince != nil && time.Since(*bs.PendingSince) > threshold {
+			problems = append(problems, fmt.Sprintf("%v has not built new commits since %v, newest is %v", name, bs.PendingSince.Format(time.RFC3339), bs.Pending))
+		}
+	}
+
+	return problems
+}
+
+// healthHandler serves /healthz, which responds with status 503 if the
+// Status reports problems, and 200 otherwise.
+type healthHandler struct {
+	status    *Status
+	threshold time.Duration
+}
+
+func (h healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	problems := h.status.health(h.threshold)
+
+	if len(problems) > 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "unhealthy", "problems": problems})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+
+	tests := []struct {
+		name  string
+		setup func(s *Status)
+		want  []string
+	}{
+		{
+			name:  "fresh",
+			setup: func(s *Status) {},
+		},
+		{
+			name: "failed polls",
+			setup: func(s *Status) {
+				s.lastPoll = old
+				s.polled(errors.New("fetch failed"))
+			},
+			want: []string{"no poll succeeded"},
+		},
+		{
+			name: "successful poll",
+			setup: func(s *Status) {
+				s.lastPoll = old
+				s.polled(nil)
+			},
+		},
+		{
+			name: "failing branch",
+			setup: func(s *Status) {
+				s.update("", "master", testCommit1, buildInfo{}, errors.New("compiling failed"))
+				s.branches[statusKey("", "master")].FailingSince = &old
+			},
+			want: []string{"(master) failing since"},
+		},
+		{
+			name: "pending commit",
+			setup: func(s *Status) {
+				s.seen("", "master", testCommit2, false)
+				s.branches[statusKey("", "master")].PendingSince = &old
+			},
+			want: []string{"(master) has not built new commits"},
+		},
+		{
+			name: "pending commit built",
+			setup: func(s *Status) {
+				s.seen("", "master", testCommit2, false)
+				s.branches[statusKey("", "master")].PendingSince = &old
+				s.update("", "master", testCommit2, buildInfo{}, nil)
+			},
+		},
+		{
+			name: "sorted branches",
+			setup: func(s *Status) {
+				for _, branch := range []string{"master", "b", "z", "a"} {
+					s.update("", branch, testCommit1, buildInfo{}, errors.New("compiling failed"))
+					s.branches[statusKey("", branch)].FailingSince = &old
+				}
+			},
+			want: []string{"(a) failing", "(b) failing", "(master) failing", "(z) failing"},
+		},
+		{
+			name: "new commit",
+			setup: func(s *Status) {
+				s.seen("", "master", testCommit2, false)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStatus()
+			test.setup(s)
+
+			problems := s.health(time.Hour)
+			if len(problems) != len(test.want) {
+				t.Fatalf("got problems %q, want %q", problems, test.want)
+			}
+
+			for i, want := range test.want {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("problem %q does not contain %q", problems[i], want)
+				}
+			}
+		})
+	}
+}
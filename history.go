@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	// defaultHistoryFile records the build durations of the repository
+	// configured with the flags.
+	defaultHistoryFile = "history.jsonl"
+
+	// maxHistory is the number of builds kept in the history file, older
+	// entries are dropped.
+	maxHistory = 1000
+
+	// statusHistory is the number of builds per branch included in the
+	// status.
+	statusHistory = 20
+)
+
+// historyEntry records the durations of a build, the history file contains
+// one entry per line.
+type historyEntry struct {
+	Time    time.Time `json:"time"`
+	Branch  string    `json:"branch,omitempty"`
+	Commit  string    `json:"commit"`
+	Version string    `json:"version"`
+	Failed  bool      `json:"failed,omitempty"`
+
+	// Duration is the total duration of the build, Targets maps each
+	// target to the time it took to compile it, in seconds.
+	Duration float64            `json:"duration"`
+	Targets  map[string]float64 `json:"targets"`
+}
+
+func newHistoryEntry(branch, commit string, info buildInfo, err error) historyEntry {
+	entry := historyEntry{
+		Time:     time.Now(),
+		Branch:   branch,
+		Commit:   commit,
+		Version:  info.Version,
+		Failed:   err != nil,
+		Duration: info.Duration.Seconds(),
+		Targets:  make(map[string]float64, len(info.Durations)),
+	}
+
+	for target, d := range info.Durations {
+		entry.Targets[target] = d.Seconds()
+	}
+
+	return entry
+}
+
+// readHistory returns the entries in filename, oldest first. A missing file
+// is an empty history.
+func readHistory(filename string) ([]historyEntry, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading history failed: %w", err)
+	}
+
+	var entries []historyEntry
+
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+
+		var entry historyEntry
+
+		err = json.Unmarshal(sc.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %v line %d failed: %w", filename, line, err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, sc.Err()
+}
+
+// appendHistory adds entry to the history in filename, only the newest
+// maxHistory entries are kept.
+func appendHistory(filename string, entry historyEntry) error {
+	entries, err := readHistory(filename)
+	if err != nil {
+		return err
+	}
+
+	entries = lastEntries(append(entries, entry), maxHistory)
+
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		err = enc.Encode(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFileAndRename(filename, buf.Bytes(), 0644)
+}
+
+// lastEntries returns the newest n entries.
+func lastEntries(entries []historyEntry, n int) []historyEntry {
+	if len(entries) > n {
+		return entries[len(entries)-n:]
+	}
+
+	return entries
+}
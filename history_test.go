@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestLastEntries(t *testing.T) {
+	entries := []historyEntry{{Version: "v1"}, {Version: "v2"}, {Version: "v3"}}
+
+	tests := []struct {
+		n    int
+		want []string
+	}{
+		{0, nil},
+		{1, []string{"v3"}},
+		{2, []string{"v2", "v3"}},
+		{3, []string{"v1", "v2", "v3"}},
+		{10, []string{"v1", "v2", "v3"}},
+	}
+
+	for _, test := range tests {
+		got := lastEntries(entries, test.n)
+
+		if len(got) != len(test.want) {
+			t.Errorf("lastEntries(%d) returned %d entries, want %v", test.n, len(got), test.want)
+			continue
+		}
+
+		for i, want := range test.want {
+			if got[i].Version != want {
+				t.Errorf("lastEntries(%d)[%d] is %v, want %v", test.n, i, got[i].Version, want)
+			}
+		}
+	}
+
+	if got := lastEntries(nil, 5); len(got) != 0 {
+		t.Errorf("lastEntries of no entries returned %v", got)
+	}
+}
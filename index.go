@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// indexFilename is the name of the generated file in the output directory
+// which lists the available builds.
+const indexFilename = "index.html"
+
+// defaultIndexTemplate renders an indexData.
+const defaultIndexTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>restic beta builds</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+td { padding: 0.1em 1em 0.1em 0; }
+.size { text-align: right; }
+</style>
+</head>
+<body>
+<h1>restic beta builds</h1>
+<p>These binaries are built automatically from the latest development version of restic, they are not official releases. Generated {{ .Generated.Format "2006-01-02 15:04 MST" }}.</p>
+{{ range .Builds }}
+<h2 id="{{ .Version }}"><a href="{{ .Dir }}/">{{ .Version }}</a></h2>
+<p>Built {{ .BuildTime.Format "2006-01-02 15:04 MST" }}{{ if .Commit }} from commit <code>{{ .Commit }}</code>{{ end }}{{ if .Checksums }}, <a href="{{ .Dir }}/{{ .Checksums }}">checksums</a>{{ end }}{{ if .Signature }} (<a href="{{ .Dir }}/{{ .Signature }}">signature</a>){{ end }}{{ if .Bundle }}, <a href="{{ .Dir }}/{{ .Bundle }}">all files</a>{{ end }}{{ if .Source }}, <a href="{{ .Dir }}/{{ .Source }}">source</a>{{ end }}</p>
+<table>
+{{ range .Files }}<tr><td><a href="{{ .Path }}">{{ .Name }}</a></td><td class="size">{{ .Size }}</td></tr>
+{{ end }}</table>
+{{ else }}
+<p>No builds available.</p>
+{{ end }}
+</body>
+</html>
+`
+
+// indexData is passed to the template for the index.
+type indexData struct {
+	Generated time.Time
+	Builds    []indexBuild
+}
+
+// indexBuild describes a version directory.
+type indexBuild struct {
+	Dir       string
+	Version   string
+	Commit    string
+	BuildTime time.Time
+	Checksums string
+	Signature string
+	Bundle    string
+	Source    string
+	Files     []indexFile
+}
+
+type indexFile struct {
+	Name string
+	Path string
+	Size string
+}
+
+// parseIndexTemplate returns the template for the index, which is read from
+// filename if it is not empty.
+func parseIndexTemplate(filename string) (*template.Template, error) {
+	text := defaultIndexTemplate
+
+	if filename != "" {
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("reading index template failed: %w", err)
+		}
+
+		text = string(buf)
+	}
+
+	return template.New("index").Parse(text)
+}
+
+// writeIndex renders tmpl for the builds in outputdir to index.html, newest
+// first. Version directories without a manifest, e.g. from failed builds,
+// are not listed.
+func writeIndex(outputdir string, tmpl *template.Template) error {
+	entries, err := ioutil.ReadDir(outputdir)
+	if err != nil {
+		return fmt.Errorf("list output dir failed: %w", err)
+	}
+
+	data := indexData{Generated: time.Now()}
+
+	for _, fi := range entries {
+		if !fi.IsDir() || !strings.HasPrefix(fi.Name(), "restic-") {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(outputdir, fi.Name(), manifestFilename))
+		if err != nil {
+			continue
+		}
+
+		var m Manifest
+
+		err = json.Unmarshal(buf, &m)
+		if err != nil {
+			return fmt.Errorf("parsing manifest in %v failed: %w", fi.Name(), err)
+		}
+
+		b := indexBuild{
+			Dir:       fi.Name(),
+			Version:   m.Version,
+			Commit:    m.Commit,
+			BuildTime: m.BuildTime,
+		}
+
+		for _, a := range m.Artifacts {
+			b.Files = append(b.Files, indexFile{
+				Name: a.Filename,
+				Path: fi.Name() + "/" + a.Filename,
+				Size: formatSize(a.Size),
+			})
+		}
+
+		sort.Slice(b.Files, func(i, j int) bool {
+			return b.Files[i].Name < b.Files[j].Name
+		})
+
+		if exists(filepath.Join(outputdir, fi.Name(), checksumsFilename)) {
+			b.Checksums = checksumsFilename
+		}
+
+		if exists(filepath.Join(outputdir, fi.Name(), bundleFilename(m.Version))) {
+			b.Bundle = bundleFilename(m.Version)
+		}
+
+		if m.Source != nil {
+			b.Source = m.Source.Filename
+		}
+
+		for _, ext := range []string{".asc", ".minisig"} {
+			if exists(filepath.Join(outputdir, fi.Name(), checksumsFilename+ext)) {
+				b.Signature = checksumsFilename + ext
+			}
+		}
+
+		data.Builds = append(data.Builds, b)
+	}
+
+	sort.Slice(data.Builds, func(i, j int) bool {
+		return data.Builds[i].BuildTime.After(data.Builds[j].BuildTime)
+	})
+
+	var buf bytes.Buffer
+
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return fmt.Errorf("render index failed: %w", err)
+	}
+
+	return writeFileAndRename(filepath.Join(outputdir, indexFilename), buf.Bytes(), 0644)
+}
+
+// formatSize returns size in a human-readable form.
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(size)/(1<<10))
+	}
+
+	return fmt.Sprintf("%d B", size)
+}
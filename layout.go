@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Layout selects how the builds are arranged in the output directory.
+type Layout string
+
+// Supported layouts.
+const (
+	// LayoutVersions stores the files of each build in its version
+	// directory.
+	LayoutVersions Layout = "versions"
+
+	// LayoutContent stores each artifact once under its SHA-256 hash in the
+	// directory objectsDirname, the version directories only contain
+	// symlinks to them besides the metadata files.
+	LayoutContent Layout = "content"
+)
+
+func parseLayout(s string) (Layout, error) {
+	switch l := Layout(s); l {
+	case LayoutVersions, LayoutContent:
+		return l, nil
+	}
+
+	return "", fmt.Errorf("unknown layout %q, valid values are versions and content", s)
+}
+
+// objectsDirname is the directory in the output directory which holds the
+// artifacts with the content layout. The files are never modified once they
+// have been written, so they can be cached forever.
+const objectsDirname = "sha256"
+
+// contentBackend publishes builds in a directory on the local file system with
+// the content layout.
+type contentBackend struct {
+	outputdir string
+}
+
+func (b contentBackend) Store(context.Context, string, string, string) error {
+	// the artifacts are moved when the build is published
+	return nil
+}
+
+// Publish moves the artifacts in dir to the objects directory, unless an
+// identical one is stored there already, and replaces them by symlinks. Then
+// dir is published like with the versions layout and the objects no version
+// refers to anymore are removed.
+func (b contentBackend) Publish(_ context.Context, dir string, info buildInfo) error {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	objdir := filepath.Join(b.outputdir, objectsDirname)
+
+	err := os.MkdirAll(objdir, 0755)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]string, len(info.Artifacts)+1)
+	for _, a := range info.Artifacts {
+		files[a.Filename] = a.SHA256
+	}
+
+	if info.Source != nil {
+		files[info.Source.Filename] = info.Source.SHA256
+	}
+
+	versiondir := filepath.Join(b.outputdir, "restic-"+info.Version)
+
+	for filename, sum := range files {
+		// the symlinks must be valid once dir has been renamed
+		link, err := filepath.Rel(filepath.Dir(filepath.Join(versiondir, filename)), filepath.Join(objdir, sum))
+		if err != nil {
+			return err
+		}
+
+		err = storeObject(filepath.Join(dir, filename), filepath.Join(objdir, sum), link)
+		if err != nil {
+			return fmt.Errorf("storing %v failed: %w", filename, err)
+		}
+	}
+
+	err = localBackend{outputdir: b.outputdir}.publish(dir, info)
+	if err != nil {
+		return err
+	}
+
+	return pruneObjects(b.outputdir)
+}
+
+// storeObject moves the file filename to obj and replaces it by a symlink to
+// link. If obj exists already, it has the same content and is kept.
+func storeObject(filename, obj, link string) error {
+	if exists(obj) {
+		slog.Debug("reusing identical artifact", "file", filename, "object", filepath.Base(obj))
+
+		err := os.Remove(filename)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := os.Rename(filename, obj)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Symlink(link, filename)
+}
+
+// pruneObjects removes the files in the objects directory of outputdir which
+// aren't referenced by a symlink in any of the version directories. The caller
+// must hold publishMu.
+func pruneObjects(outputdir string) error {
+	objdir := filepath.Join(outputdir, objectsDirname)
+
+	objects, err := ioutil.ReadDir(objdir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("list objects failed: %w", err)
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(outputdir, "restic-*"))
+	if err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+
+	for _, dir := range dirs {
+		err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+				return err
+			}
+
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			if filepath.Base(filepath.Dir(link)) == objectsDirname {
+				used[filepath.Base(link)] = true
+			}
+
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("list version dir failed: %w", err)
+		}
+	}
+
+	for _, fi := range objects {
+		if used[fi.Name()] {
+			continue
+		}
+
+		slog.Info("removing unused object", "object", fi.Name())
+
+		err = os.Remove(filepath.Join(objdir, fi.Name()))
+		if err != nil {
+			return fmt.Errorf("remove object failed: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// lockFilename is the file in the git directory of each clone which is locked
+// while an instance of the builder uses the clone.
+const lockFilename = "beta.lock"
+
+// errLocked is returned by lockFile if another process holds the lock.
+var errLocked = errors.New("locked by another process")
+
+// lockRepo takes the lock for the clone in dir, so that a second instance
+// started by accident doesn't race with this one for the clone and the
+// output. The lock is released by closing the returned file or by exiting.
+func lockRepo(dir string) (*os.File, error) {
+	return lockFile(filepath.Join(dir, ".git", lockFilename))
+}
@@ -0,0 +1,47 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on filename, which is created if needed,
+// and writes the process ID to it. If another process holds the lock, an
+// error wrapping errLocked is returned right away.
+func lockFile(filename string) (*os.File, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		buf, _ := ioutil.ReadAll(f)
+		_ = f.Close()
+
+		return nil, fmt.Errorf("%v is %w (pid %v)", filename, errLocked, strings.TrimSpace(string(buf)))
+	}
+
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
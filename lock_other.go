@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func lockFile(filename string) (*os.File, error) {
+	return nil, errors.ErrUnsupported
+}
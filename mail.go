@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTPConfig describes the mail server and addresses for notifications.
+type SMTPConfig struct {
+	Host string
+	Port int
+	From string
+	To   []string
+
+	// Username and Password are used for authentication if Username is
+	// set.
+	Username string
+	Password string
+}
+
+// mailLogLines is the number of lines included from the end of the log of
+// each failed target.
+const mailLogLines = 20
+
+// notifyMail sends a mail about the failed build, or the first successful
+// build after a failure if err is nil. The logs of the failed targets are
+// read from logdir.
+func notifyMail(cfg SMTPConfig, repo, branch, commit, logdir string, info buildInfo, err error) error {
+	name := buildName(repo, branch)
+
+	var subject string
+	var body bytes.Buffer
+
+	fmt.Fprintf(&body, "Version: %v\nCommit:  %v\n\n", info.Version, commit)
+
+	if err == nil {
+		subject = fmt.Sprintf("%v build fixed: %v", name, info.Version)
+		body.WriteString("The build succeeded again.\n")
+	} else {
+		subject = fmt.Sprintf("%v build failed: %v", name, info.Version)
+		fmt.Fprintf(&body, "Error: %v\n", err)
+
+		for _, target := range failedTargets(info) {
+			fmt.Fprintf(&body, "\n%v: %v\n", target, info.Failed[target])
+
+			logfile := filepath.Join(logdir, targetLogFilename(target))
+
+			tail, err := tailFile(logfile, mailLogLines)
+			if err != nil {
+				continue
+			}
+
+			fmt.Fprintf(&body, "\n%v\n", indent(tail))
+		}
+	}
+
+	if info.Changes != nil {
+		fmt.Fprintf(&body, "\nChanges since %v:\n\n%v\n", info.Changes.Since, indent(strings.Join(info.Changes.Commits, "\n")))
+	}
+
+	if info.VetOutput != "" {
+		fmt.Fprintf(&body, "\ngo vet reported issues:\n\n%v\n", indent(lastLines(info.VetOutput, mailLogLines)))
+	}
+
+	var msg bytes.Buffer
+
+	fmt.Fprintf(&msg, "From: %v\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %v\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %v\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+
+	err = smtp.SendMail(addr, auth, cfg.From, cfg.To, msg.Bytes())
+	if err != nil {
+		return fmt.Errorf("sending mail failed: %w", err)
+	}
+
+	return nil
+}
+
+// tailFile returns the last n lines of the file.
+func tailFile(filename string, n int) (string, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	return lastLines(string(buf), n), nil
+}
+
+// lastLines returns the last n lines of s.
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func indent(s string) string {
+	return "    " + strings.ReplaceAll(s, "\n", "\n    ")
+}
@@ -1,14 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
+	"text/template"
 	"time"
 )
 
@@ -25,17 +37,249 @@ func exists(dir string) bool {
 	return true
 }
 
-func clone(url, dir string) error {
-	fmt.Printf("clone repo %v\n", url)
-	cmd := exec.Command("git", "clone", "--quiet", url, dir)
+// permanentGitErrors lists messages printed by git for errors which won't go
+// away by retrying, e.g. missing credentials or a wrong URL.
+var permanentGitErrors = []string{
+	"Authentication failed",
+	"Permission denied",
+	"Repository not found",
+	"could not read Username",
+	"does not appear to be a git repository",
+}
+
+// gitWaitDelay is the time to wait for the output of git to be closed after
+// it has been killed, helpers like git-remote-https may still hold it open.
+const gitWaitDelay = time.Second
+
+// runRemote runs git with args in dir, which talks to the remote repository.
+// It is killed when ctx is canceled or after remote.Timeout. The returned
+// error is marked as permanent if git's output shows that retrying won't help.
+// With remote.Progress, git's progress output is logged.
+func runRemote(ctx context.Context, remote Remote, dir string, args ...string) error {
+	if remote.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, remote.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = remote.env()
+	cmd.Dir = dir
+	cmd.WaitDelay = gitWaitDelay
+
+	var stderr bytes.Buffer
+
+	var out io.Writer = os.Stderr
+	if remote.Progress {
+		out = newProgressLogger(slog.With("url", remote.redactedURL()))
+	}
+
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = io.MultiWriter(out, &stderr)
 
-	return cmd.Run()
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		// a stalled connection is retried
+		return fmt.Errorf("git %v timed out after %v: %w", args[0], remote.Timeout, err)
+	case ctx.Err() != nil:
+		// interrupted, e.g. on shutdown
+		return ctx.Err()
+	}
+
+	for _, msg := range permanentGitErrors {
+		if strings.Contains(stderr.String(), msg) {
+			return permanentError{fmt.Errorf("%v: %w", msg, err)}
+		}
+	}
+
+	return err
+}
+
+// Remote describes the upstream repository and how to authenticate to it.
+type Remote struct {
+	URL string
+
+	// Token is sent as the password for HTTPS URLs.
+	Token string
+
+	// SSHKey is the path to the private key used for SSH URLs.
+	SSHKey string
+
+	// Shallow only fetches the newest commit of each branch. Without the
+	// history, git describe cannot find the tags, so the versions are
+	// named after the commits.
+	Shallow bool
+
+	// Progress logs the progress of clones and fetches reported by git.
+	Progress bool
+
+	// Timeout limits the time of each git command talking to the remote
+	// repository, zero means no limit.
+	Timeout time.Duration
+
+	// Forge is the type of the service hosting the repository, see
+	// newForge.
+	Forge string
+}
+
+// forge returns the service hosting the repository.
+func (r Remote) forge() Forge {
+	return newForge(r.Forge, r.URL)
+}
+
+// verbosityArg returns the argument which makes git report its progress for
+// r, or makes it quiet.
+func (r Remote) verbosityArg() string {
+	if r.Progress {
+		return "--progress"
+	}
+
+	return "--quiet"
+}
+
+// depthArgs returns the arguments which limit the history fetched from r. For
+// shallow clones, the tags are fetched explicitly so that builds of tagged
+// commits are named after the tag.
+func (r Remote) depthArgs() []string {
+	if !r.Shallow {
+		return nil
+	}
+
+	return []string{"--depth", "1", "--tags"}
+}
+
+// env returns the environment variables which configure git to use the
+// credentials. The token is passed via GIT_CONFIG_* so that it neither ends
+// up in the command line nor in the repository's configuration.
+func (r Remote) env() []string {
+	env := os.Environ()
+
+	if r.Token != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + r.Token))
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+
+	if r.SSHKey != "" {
+		env = append(env, "GIT_SSH_COMMAND=ssh -i "+shellQuote(r.SSHKey)+" -o IdentitiesOnly=yes")
+	}
+
+	return env
+}
+
+// redactedURL returns the URL with any password removed, for logging.
+func (r Remote) redactedURL() string {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		// probably an scp-like SSH address, which has no password
+		return r.URL
+	}
+
+	return u.Redacted()
+}
+
+// shellQuote quotes s for use in a command interpreted by the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func clone(ctx context.Context, remote Remote, dir string) error {
+	slog.Info("clone repo", "url", remote.redactedURL())
+	args := []string{"clone", remote.verbosityArg()}
+	if remote.Shallow {
+		args = append(args, "--depth", "1", "--no-single-branch")
+	}
+
+	start := time.Now()
+
+	err := runRemote(ctx, remote, "", append(args, remote.forge().CloneURL(), dir)...)
+	if err != nil {
+		return CloneError{URL: remote.redactedURL(), Err: err}
+	}
+
+	logCloneDone(dir, start)
+
+	return nil
 }
 
-func update(dir string) error {
-	cmd := exec.Command("git", "pull", "--quiet")
+// reclone replaces the clone in dir by a fresh one. The old clone is only
+// removed once the new one is complete, so dir is left alone if the remote
+// can't be reached.
+func reclone(ctx context.Context, git Git, remote Remote, dir string) error {
+	tempdir := dir + ".new"
+
+	err := os.RemoveAll(tempdir)
+	if err != nil {
+		return err
+	}
+
+	err = git.Clone(ctx, remote, tempdir)
+	if err != nil {
+		_ = os.RemoveAll(tempdir)
+		return err
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return fmt.Errorf("removing old clone failed: %w", err)
+	}
+
+	return os.Rename(tempdir, dir)
+}
+
+func update(ctx context.Context, remote Remote, dir string) error {
+	if remote.Shallow {
+		// pulling into a shallow clone needs the history for merging,
+		// so reset to the fetched commit instead
+		err := fetch(ctx, remote, dir)
+		if err != nil {
+			return err
+		}
+
+		cmd := exec.CommandContext(ctx, "git", "reset", "--quiet", "--hard", "@{upstream}")
+		cmd.Stderr = os.Stderr
+		cmd.Dir = dir
+
+		err = cmd.Run()
+		if err != nil {
+			return UpdateError{Err: fmt.Errorf("reset: %w", err)}
+		}
+
+		return nil
+	}
+
+	err := runRemote(ctx, remote, dir, "pull", remote.verbosityArg())
+	if err != nil {
+		return UpdateError{Err: err}
+	}
+
+	return nil
+}
+
+// fetch updates the remote-tracking branches without touching the working
+// tree.
+func fetch(ctx context.Context, remote Remote, dir string) error {
+	args := append([]string{"fetch", remote.verbosityArg()}, remote.depthArgs()...)
+
+	err := runRemote(ctx, remote, dir, append(args, "origin")...)
+	if err != nil {
+		return UpdateError{Err: err}
+	}
+
+	return nil
+}
+
+// checkout switches the working tree to commit, leaving HEAD detached.
+func checkout(ctx context.Context, dir, commit string) error {
+	cmd := exec.CommandContext(ctx, "git", "checkout", "--quiet", "--force", "--detach", commit)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Dir = dir
@@ -43,80 +287,370 @@ func update(dir string) error {
 	return cmd.Run()
 }
 
-func commitID(dir string) string {
-	cmd := exec.Command("git", "rev-parse", "HEAD")
+// commitID returns the commit ID rev resolves to.
+func commitID(ctx context.Context, dir, rev string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", "--verify", "--quiet", rev+"^{commit}")
 	cmd.Stderr = os.Stderr
 	cmd.Dir = dir
 
 	buf, err := cmd.Output()
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("resolving %v failed: %w", rev, err)
 	}
 
-	return strings.TrimSpace(string(buf))
+	return strings.TrimSpace(string(buf)), nil
 }
 
-// getVersionFromGit returns a version string that identifies the currently
-// checked out git commit.
-func getVersionFromGit(repodir string) string {
-	cmd := exec.Command("git", "describe",
-		"--long", "--tags", "--dirty", "--always")
-	cmd.Dir = repodir
+// changedFiles returns the names of the files which differ between the
+// commits old and new.
+func changedFiles(ctx context.Context, dir, old, new string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "git", "diff", "--name-only", old, new)
+	cmd.Stderr = os.Stderr
+	cmd.Dir = dir
+
+	buf, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git diff returned error: %w", err)
+	}
+
+	return strings.Fields(string(buf)), nil
+}
+
+// previousTag returns the newest tag matching the glob pattern which is an
+// ancestor of tag, excluding tag itself.
+func previousTag(ctx context.Context, dir, tag, pattern string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "describe", "--tags", "--abbrev=0", "--match", pattern, tag+"^")
+	cmd.Dir = dir
 
 	out, err := cmd.Output()
 	if err != nil {
-		panic(fmt.Sprintf("git describe returned error: %v\n", err))
+		return "", fmt.Errorf("git describe returned error: %w", err)
 	}
 
-	return strings.TrimSpace(string(out))
+	return strings.TrimSpace(string(out)), nil
 }
 
-func readCurrentCommit(commitfile string) (string, error) {
-	buf, err := ioutil.ReadFile(commitfile)
-	if os.IsNotExist(err) {
-		return "", nil
+// shortlog returns the commits in old..new with the abbreviated hash and the
+// subject, newest first. At most max commits are returned, more reports
+// whether there are others.
+func shortlog(ctx context.Context, dir, old, new string, max int) (commits []string, more bool, err error) {
+	cmd := exec.CommandContext(ctx, "git", "log", "--oneline", "--no-decorate", fmt.Sprintf("--max-count=%d", max+1), old+".."+new)
+	cmd.Stderr = os.Stderr
+	cmd.Dir = dir
+
+	buf, err := cmd.Output()
+	if err != nil {
+		return nil, false, fmt.Errorf("git log returned error: %w", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil, false, nil
+	}
+
+	if len(lines) > max {
+		return lines[:max], true, nil
 	}
 
+	return lines, false, nil
+}
+
+// describeCommit returns the version string for commit, like
+// getVersionFromGit does for the working tree.
+func describeCommit(ctx context.Context, repodir, commit string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "describe", "--long", "--tags", "--always", commit)
+	cmd.Dir = repodir
+
+	out, err := cmd.Output()
 	if err != nil {
-		return "", fmt.Errorf("reading commit failed: %w", err)
+		slog.Warn("git describe failed, using the commit hash as version", "commit", commit, "err", err)
+		return shortCommit(ctx, repodir, commit)
 	}
 
-	return string(buf), nil
+	return strings.TrimSpace(string(out)), nil
 }
 
-func writeCurrentCommit(commitfile, commit string) error {
-	return ioutil.WriteFile(commitfile, []byte(commit), 0600)
+// getVersionFromGit returns a version string that identifies the currently
+// checked out git commit. If git describe fails, the abbreviated commit hash
+// is used.
+func getVersionFromGit(ctx context.Context, repodir string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "describe",
+		"--long", "--tags", "--dirty", "--always")
+	cmd.Dir = repodir
+
+	out, err := cmd.Output()
+	if err != nil {
+		slog.Warn("git describe failed, using the commit hash as version", "err", err)
+		return shortCommit(ctx, repodir, "HEAD")
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// shortCommit returns the abbreviated hash of rev.
+func shortCommit(ctx context.Context, repodir, rev string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", "--short", rev)
+	cmd.Dir = repodir
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse returned error: %w", err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
 }
 
 // BuildTarget specifies an OS/architecture pair for compilation.
 type BuildTarget struct {
-	OS   string
-	Arch string
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+
+	// Variant optionally selects the micro-architecture, it is passed in
+	// $GOARM, $GOAMD64 or $GO386 depending on Arch, e.g. "7" for arm or
+	// "v3" for amd64.
+	Variant string `json:"variant,omitempty"`
+
+	// Env lists additional environment variables for compiling, e.g. CC
+	// for cgo. They take precedence over the variables set by the
+	// builder, like GOOS, GOARCH and CGO_ENABLED.
+	Env map[string]string `json:"env,omitempty"`
+
+	// Profile is the name of the build profile, empty for the default
+	// one. It is set when the targets are expanded for the profiles, not
+	// in the targets file.
+	Profile string `json:"profile,omitempty"`
+}
+
+func (t BuildTarget) String() string {
+	if t.Profile != "" {
+		return t.OS + "/" + t.ArchName() + "+" + t.Profile
+	}
+
+	return t.OS + "/" + t.ArchName()
+}
+
+// base returns t for the default profile, the settings for targets like
+// -cgo apply to all profiles.
+func (t BuildTarget) base() BuildTarget {
+	t.Profile = ""
+	return t
+}
+
+// ArchName returns the architecture including the variant, e.g. "armv7" or
+// "amd64v3". Numeric variants are prefixed with a "v".
+func (t BuildTarget) ArchName() string {
+	if t.Variant == "" {
+		return t.Arch
+	}
+
+	if t.Variant[0] >= '0' && t.Variant[0] <= '9' {
+		return t.Arch + "v" + t.Variant
+	}
+
+	return t.Arch + t.Variant
+}
+
+// platform returns the name of the OS/architecture pair without the variant,
+// as listed by "go tool dist list".
+func (t BuildTarget) platform() string {
+	return t.OS + "/" + t.Arch
+}
+
+// variantVars maps the architectures to the environment variable selecting
+// their micro-architecture.
+var variantVars = map[string]string{
+	"arm":   "GOARM",
+	"amd64": "GOAMD64",
+	"386":   "GO386",
+}
+
+// env returns the environment variables for compiling for t with cgo enabled
+// or disabled. The variables from t.Env come last, so they override the
+// others.
+func (t BuildTarget) env(cgo bool) []string {
+	env := []string{"GOOS=" + t.OS, "GOARCH=" + t.Arch, cgoEnv(cgo)}
+	if t.Variant != "" {
+		env = append(env, variantVars[t.Arch]+"="+t.Variant)
+	}
+
+	keys := make([]string, 0, len(t.Env))
+	for key := range t.Env {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		env = append(env, key+"="+t.Env[key])
+	}
+
+	return env
 }
 
 // BuildTargets is a list of OS/architecture pairs to build for.
 var BuildTargets = []BuildTarget{
-	{"darwin", "amd64"},
-	{"darwin", "arm64"},
-	{"freebsd", "386"},
-	{"freebsd", "amd64"},
-	{"freebsd", "arm"},
-	{"linux", "386"},
-	{"linux", "amd64"},
-	{"linux", "arm"},
-	{"linux", "arm64"},
-	{"linux", "ppc64le"},
-	{"openbsd", "386"},
-	{"openbsd", "amd64"},
-	{"windows", "386"},
-	{"windows", "amd64"},
+	{OS: "darwin", Arch: "amd64"},
+	{OS: "darwin", Arch: "arm64"},
+	{OS: "freebsd", Arch: "386"},
+	{OS: "freebsd", Arch: "amd64"},
+	{OS: "freebsd", Arch: "arm"},
+	{OS: "linux", Arch: "386"},
+	{OS: "linux", Arch: "amd64"},
+	{OS: "linux", Arch: "arm"},
+	{OS: "linux", Arch: "arm64"},
+	{OS: "linux", Arch: "ppc64le"},
+	{OS: "openbsd", Arch: "386"},
+	{OS: "openbsd", Arch: "amd64"},
+	{OS: "windows", Arch: "386"},
+	{OS: "windows", Arch: "amd64"},
+	{OS: "windows", Arch: "arm64"},
+}
+
+// loadTargets reads the list of build targets from the JSON file at path. If
+// the file does not exist, the built-in list BuildTargets is returned. Invalid
+// entries are an error, unless skipInvalid is set, then they are only logged.
+func loadTargets(path string, skipInvalid bool) ([]BuildTarget, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return BuildTargets, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading targets failed: %w", err)
+	}
+
+	var targets []BuildTarget
+
+	err = json.Unmarshal(buf, &targets)
+	if err != nil {
+		return nil, fmt.Errorf("parsing targets file %v failed: %w", path, err)
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("targets file %v does not contain any targets", path)
+	}
+
+	var valid []BuildTarget
+
+	for i, target := range targets {
+		err := checkTarget(target)
+		if err != nil && !skipInvalid {
+			return nil, fmt.Errorf("targets file %v: entry %d (%q) %w", path, i, target, err)
+		}
+
+		if err != nil {
+			slog.Warn("skipping invalid target", "file", path, "entry", i, "target", target, "err", err)
+			continue
+		}
+
+		valid = append(valid, target)
+	}
+
+	if len(valid) == 0 {
+		return nil, fmt.Errorf("targets file %v does not contain any valid targets", path)
+	}
+
+	return valid, nil
+}
+
+// checkTarget returns an error if target is not a valid entry of the targets
+// file.
+func checkTarget(target BuildTarget) error {
+	if target.OS == "" || target.Arch == "" {
+		return errors.New("needs both os and arch")
+	}
+
+	if _, ok := variantVars[target.Arch]; target.Variant != "" && !ok {
+		return fmt.Errorf("has a variant, which is not supported for %v", target.Arch)
+	}
+
+	if target.Profile != "" {
+		return errors.New("has a profile, they are configured with -profiles")
+	}
+
+	for key := range target.Env {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("has an invalid environment variable %q", key)
+		}
+	}
+
+	return nil
+}
+
+// filterTargets returns the targets named in list, a comma-separated list of
+// os/arch pairs. Each must be one of targets.
+func filterTargets(targets []BuildTarget, list string) ([]BuildTarget, error) {
+	known := make(map[string]BuildTarget, len(targets))
+	for _, target := range targets {
+		known[target.String()] = target
+	}
+
+	var selected []BuildTarget
+
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+
+		goos, goarch, ok := strings.Cut(name, "/")
+		if !ok || goos == "" || goarch == "" {
+			return nil, fmt.Errorf("invalid target %q, want os/arch", name)
+		}
+
+		target, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown target %q", name)
+		}
+
+		selected = append(selected, target)
+	}
+
+	return selected, nil
+}
+
+// cgoEnv returns the environment variable which enables or disables cgo.
+func cgoEnv(enabled bool) string {
+	if enabled {
+		return "CGO_ENABLED=1"
+	}
+
+	return "CGO_ENABLED=0"
+}
+
+// parseEmulators parses list, a comma-separated list of os/arch=command
+// pairs. Each target must be one of targets.
+func parseEmulators(targets []BuildTarget, list string) (map[string]string, error) {
+	emulators := make(map[string]string)
+	if list == "" {
+		return emulators, nil
+	}
+
+	for _, entry := range strings.Split(list, ",") {
+		name, command, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || strings.TrimSpace(command) == "" {
+			return nil, fmt.Errorf("invalid entry %q, want os/arch=command", entry)
+		}
+
+		_, err := filterTargets(targets, name)
+		if err != nil {
+			return nil, err
+		}
+
+		emulators[strings.TrimSpace(name)] = command
+	}
+
+	return emulators, nil
 }
 
 // symlinkAndRename atomically creates a symlink by using symlink+rename.
 func symlinkAndRename(oldname, newname string) error {
 	tempname := filepath.Join(filepath.Dir(newname), "symlink-"+filepath.Base(oldname))
 
-	err := os.Symlink(oldname, tempname)
+	// remove a leftover from an interrupted earlier run
+	err := os.Remove(tempname)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove: %w", err)
+	}
+
+	err = os.Symlink(oldname, tempname)
 	if err != nil {
 		return fmt.Errorf("symlink: %w", err)
 	}
@@ -129,99 +663,329 @@ func symlinkAndRename(oldname, newname string) error {
 	return nil
 }
 
-func build(repodir, outputdir string) error {
-	version := getVersionFromGit(repodir)
-	start := time.Now()
-	outputdir = filepath.Join(outputdir, fmt.Sprintf("restic-%v", version))
+// Config collects the settings of the builder.
+type Config struct {
+	Targets  []BuildTarget
+	Compress Compression
 
-	fmt.Printf("compiling %v\n", version)
+	// Keep is the number of version directories retained in the output
+	// directory, zero disables pruning.
+	Keep int
 
-	err := os.MkdirAll(outputdir, 0755)
-	if err != nil {
-		return fmt.Errorf("mkdir output dir failed: %w", err)
-	}
+	// Jobs is the number of targets compiled concurrently. Each compiler
+	// process is parallel on its own, so on machines with little memory
+	// setting it to one serializes the builds.
+	Jobs int
 
-	ch := make(chan BuildTarget)
+	// Uploads is the number of artifacts stored by the backend
+	// concurrently, independent of Jobs, so that a remote backend is not
+	// flooded with uploads.
+	Uploads int
 
-	var wg sync.WaitGroup
+	// RunTests enables running the test suite before building, it is
+	// aborted after TestTimeout.
+	RunTests    bool
+	TestTimeout time.Duration
 
-	for i := 0; i < runtime.NumCPU(); i++ {
-		wg.Add(1)
+	// Vet runs go vet before building, it is aborted after VetTimeout.
+	// The findings are logged and included in the notifications, with
+	// VetStrict they also fail the build.
+	Vet        bool
+	VetStrict  bool
+	VetTimeout time.Duration
 
-		go func() {
-			defer wg.Done()
+	// BuildTimeout limits the time for compiling a single target, the
+	// target fails if it is exceeded. Zero means no limit.
+	BuildTimeout time.Duration
 
-			for build := range ch {
-				filename := fmt.Sprintf("restic_%v_%v_%v", version, build.OS, build.Arch)
+	// LDFlags is the template for the linker flags, it is rendered with
+	// the fields Version and Commit.
+	LDFlags *template.Template
 
-				if build.OS == "windows" {
-					filename += ".exe"
-				}
+	// Strip removes debug information from the binaries.
+	Strip bool
 
-				cmd := exec.Command("go", "build", "-o", filepath.Join(outputdir, filename), "./cmd/restic")
-				cmd.Stdout = os.Stdout
-				cmd.Stderr = os.Stderr
-				cmd.Dir = repodir
-				cmd.Env = append(os.Environ(),
-					"GOOS="+build.OS,
-					"GOARCH="+build.Arch,
-					"CGO_ENABLED=0",
-				)
+	// UPX packs the executables with UPX for the targets it supports.
+	UPX bool
 
-				err := cmd.Run()
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "compiling %v for %v/%v failed: %v\n",
-						version, build.OS, build.Arch, err)
-					panic(err)
-				}
-			}
-		}()
-	}
+	// Reproducible makes the binaries only depend on the source code and
+	// the Go version, VerifyReproducible checks this by compiling each
+	// target twice.
+	Reproducible       bool
+	VerifyReproducible bool
 
-	for _, target := range BuildTargets {
-		ch <- target
-	}
+	// VerifyBinaries runs the binaries built for the host after compiling
+	// them and fails the targets which don't print their version.
+	// Emulators maps other targets to the command line for running their
+	// binaries, e.g. "linux/arm64" to "qemu-aarch64".
+	VerifyBinaries bool
+	Emulators      map[string]string
+
+	// CGO lists the targets which are compiled with cgo enabled, it is
+	// disabled for all others.
+	CGO map[string]bool
+
+	// MaxGrowth is the growth of a binary in percent compared to the
+	// previous version above which a warning is logged, zero disables it.
+	MaxGrowth float64
+
+	// BuildArgs are appended to the flags for go build, e.g. -tags. They
+	// take precedence over the flags set by the builder.
+	BuildArgs []string
+
+	// DryRun only logs what would be built, without building or writing
+	// anything.
+	DryRun bool
+
+	// S3, if set, selects uploading the builds to an S3 bucket instead of
+	// publishing them in the output directory, which is then only used
+	// for collecting the files of a build.
+	S3 *S3Config
+
+	// Name is the template for the names of the binaries.
+	Name *template.Template
+
+	// Version derives the versions of the builds of branches, tags are
+	// always built under their name.
+	Version VersionScheme
+
+	// Bundle also publishes all files of a build in a single tar.gz.
+	Bundle bool
+
+	// PostBuildHook is a command run after each successful build, see
+	// runHook. If PostBuildHookFatal is set, the build fails if the
+	// command does.
+	PostBuildHook      string
+	PostBuildHookFatal bool
+
+	// Incremental writes the binaries to the version directory in the
+	// output directory as soon as they are built and updates the manifest
+	// and the index after each one. The version directory is incomplete
+	// until the build has finished, and stays so if it fails. The
+	// "latest" symlinks are only updated after a complete build.
+	Incremental bool
+
+	// Dedup replaces binaries which are identical to the previous version
+	// by hardlinks, it isn't used with S3.
+	Dedup bool
+
+	// Layout is the arrangement of the output directory, LayoutContent
+	// isn't supported with S3, Staging, Incremental and Dedup.
+	Layout Layout
+
+	// Staging publishes the builds in the subdirectory "staging" of the
+	// output directory, from where they are promoted manually.
+	Staging bool
+
+	// MinFree is the number of bytes which must be available in the output
+	// directory before a build is started, 0 disables the check. If
+	// PruneLowSpace is set, old builds are removed to make room.
+	MinFree       int64
+	PruneLowSpace bool
+
+	// Sign, if set, signs the checksums file of each build.
+	Sign *SignConfig
+
+	// Index is the template for the index.html generated in the output
+	// directory, it isn't used with S3.
+	Index *htmltemplate.Template
+
+	// Queue, if set, also hands out the targets to remote workers.
+	Queue *jobQueue
+
+	// IgnorePaths lists the patterns for files which don't affect the
+	// binaries. If all files changed by a new commit match, it is not
+	// built. A pattern ending in a slash matches everything in that
+	// directory, a pattern without a slash is matched against the base
+	// name of each file.
+	IgnorePaths []string
+
+	// TagPattern, if set, is the glob pattern for tags, e.g. of release
+	// candidates, which are built once each into the subdirectory
+	// tagDirname of the output directory.
+	TagPattern string
+
+	// WebhookURL receives a notification about each build if set. For
+	// the WebhookType slack or discord, the notifications are formatted as
+	// chat messages and only sent if a build failed or succeeded again.
+	WebhookURL  string
+	WebhookType string
+
+	// NotifyFirstSuccess sends a recovery notification via mail and chat
+	// webhooks for the first successful build of a branch after a failure.
+	// The generic webhook marks it as recovered regardless.
+	NotifyFirstSuccess bool
+
+	// SMTP, if set, configures sending mails when the build fails or is
+	// fixed again.
+	SMTP *SMTPConfig
+
+	// QuietPeriod is the time the tip of a branch must not have changed
+	// before it is built, zero builds new commits right away.
+	QuietPeriod time.Duration
+
+	// CleanAfter is the number of consecutive failed updates of a clone
+	// after which it is removed and cloned again, zero disables this.
+	CleanAfter int
+
+	// QuarantineAfter is the number of consecutive failed builds of a
+	// target after which it is skipped, zero disables this. Quarantined
+	// targets are retried after QuarantineCooldown, or only once they are
+	// reset if it is zero.
+	QuarantineAfter    int
+	QuarantineCooldown time.Duration
+
+	// MaxBuildAge is the age after which the commit of a branch is built
+	// again even if it hasn't changed, e.g. to pick up fixes of the Go
+	// toolchain. Zero disables this.
+	MaxBuildAge time.Duration
+
+	// MaxBuildsPerHour limits the number of builds started by the daemon
+	// of a repository within an hour, zero disables the limit. Deferred
+	// branches build their latest commit once the limit allows it.
+	MaxBuildsPerHour int
+
+	// WindowsResources, if set, embeds version information and an icon
+	// into the binaries for Windows which are compiled locally.
+	WindowsResources *WindowsResources
+
+	// Notary, if set, signs the macOS binaries and submits them to Apple's
+	// notary service, which only works on a Mac.
+	Notary *Notary
+
+	// Source publishes an archive of the source code of the commit with
+	// each build.
+	Source bool
+
+	// ProfileResources logs and records the memory usage, the number of
+	// goroutines and of running compilers periodically while building.
+	ProfileResources bool
+
+	// Progress, if set, records the state of the targets while building.
+	Progress *progressTracker
+
+	// Package is the path of the main package which is built, relative to
+	// the repository, e.g. "./cmd/restic".
+	Package string
+
+	// Profiles maps the names of the additional build profiles to their
+	// settings, Targets contains each target for each of them.
+	Profiles map[string]BuildProfile
+
+	// Changes is set for the build of a tag to the commits since the
+	// previous one, it is recorded in the manifest and the notifications.
+	Changes *Changes
+
+	// Rebuild compiles all targets, even those built successfully by an
+	// earlier build of the same commit which failed or was interrupted.
+	Rebuild bool
 
-	close(ch)
+	// VerifyPublished checks the binaries of the latest published build of
+	// each branch against the manifest at startup, or before each poll with
+	// VerifyEachPoll. RebuildCorrupt rebuilds the branches, or the tag,
+	// whose published binaries were modified.
+	VerifyPublished bool
+	VerifyEachPoll  bool
+	RebuildCorrupt  bool
+}
 
-	wg.Wait()
+// writeFileAndRename atomically replaces filename with data by writing to a
+// temporary file first.
+func writeFileAndRename(filename string, data []byte, perm os.FileMode) error {
+	tempname := filepath.Join(filepath.Dir(filename), "tmp-"+filepath.Base(filename))
 
-	fmt.Printf("built version %v in %v\n", version, time.Since(start))
+	err := ioutil.WriteFile(tempname, data, perm)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
 
-	// create new symlink "latest" pointing to the current dir
-	err = symlinkAndRename(filepath.Base(outputdir), filepath.Join(filepath.Dir(outputdir), "latest"))
+	err = os.Rename(tempname, filename)
 	if err != nil {
-		return err
+		_ = os.Remove(tempname)
+		return fmt.Errorf("rename: %w", err)
 	}
 
-	for _, build := range BuildTargets {
-		filename := fmt.Sprintf("restic_%v_%v_%v", version, build.OS, build.Arch)
-		if build.OS == "windows" {
-			filename += ".exe"
-		}
+	return nil
+}
+
+// updateLatest points the "latest" symlink in outputdir to the version
+// directory versiondir. On Windows, where symlinks require special
+// privileges, the file "latest.txt" containing the version is written
+// instead.
+func updateLatest(outputdir, versiondir, version string) error {
+	if runtime.GOOS == "windows" {
+		return writeFileAndRename(filepath.Join(outputdir, "latest.txt"), []byte(version+"\n"), 0644)
+	}
+
+	return symlinkAndRename(versiondir, filepath.Join(outputdir, "latest"))
+}
 
-		symlink := fmt.Sprintf("latest_restic_%v_%v", build.OS, build.Arch)
+// readLatest returns the name of the version directory in outputdir which was
+// published last, or the empty string if there is none.
+func readLatest(outputdir string) (string, error) {
+	if runtime.GOOS == "windows" {
+		buf, err := ioutil.ReadFile(filepath.Join(outputdir, "latest.txt"))
+		if os.IsNotExist(err) {
+			return "", nil
+		}
 
-		err = symlinkAndRename(
-			filepath.Join(filepath.Base(outputdir), filename),
-			filepath.Join(filepath.Dir(outputdir), symlink))
 		if err != nil {
-			return err
+			return "", err
 		}
+
+		return "restic-" + strings.TrimSpace(string(buf)), nil
 	}
 
-	return nil
+	target, err := os.Readlink(filepath.Join(outputdir, "latest"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Base(target), nil
 }
 
 const (
-	repodir      = "restic.git"
-	outputdir    = "/var/www/beta.restic.net"
-	commitfile   = "commit.current"
-	pollInterval = 5 * time.Minute
+	// defaultRepoDir and defaultOutputDir are used for the repository
+	// configured with the flags
+	defaultRepoDir   = "restic.git"
+	defaultOutputDir = "/var/www/beta.restic.net"
+
+	// defaultPollInterval is the time between checks for new commits,
+	// minPollInterval is the lower limit to not hammer the remote
+	defaultPollInterval = 5 * time.Minute
+	minPollInterval     = 30 * time.Second
+
+	// defaultLDFlags sets the variables restic reports in "restic version"
+	defaultLDFlags = "-X main.version={{.Version}} -X main.commit={{.Commit}}"
+
+	// remoteAttempts is the number of tries for git operations which
+	// contact the remote repository
+	remoteAttempts = 5
 )
 
+// goBinary is the go command used for building, it is set from the flags by
+// setupGoBinary.
+var goBinary = "go"
+
+// setupGoBinary selects the go command at path, which is looked up in $PATH
+// if it doesn't contain a slash. The absolute path is used because the
+// commands are run in other directories.
+func setupGoBinary(path string) error {
+	p, err := exec.LookPath(path)
+	if err != nil {
+		return err
+	}
+
+	goBinary, err = filepath.Abs(p)
+	return err
+}
+
 func goVersion() (string, error) {
-	cmd := exec.Command("go", "version")
+	cmd := exec.Command(goBinary, "version")
 	cmd.Stderr = os.Stderr
 
 	buf, err := cmd.Output()
@@ -229,57 +993,179 @@ func goVersion() (string, error) {
 		return "", fmt.Errorf("detect go version failed: %w", err)
 	}
 
-	return string(buf), nil
+	return strings.TrimSpace(string(buf)), nil
 }
 
-func main() {
-	v, err := goVersion()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable to get Go version: %v\n", err)
-		os.Exit(1)
+// targetMinGoVersion maps targets to the first minor version of Go 1 which
+// supports them.
+var targetMinGoVersion = map[string]int{
+	"darwin/arm64":  16,
+	"windows/arm64": 17,
+}
+
+// goRelease matches Go versions like go1.22.3, the output of "go version" for
+// development versions contains e.g. go1.23-abcdef.
+var goRelease = regexp.MustCompile(`go(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// parseGoVersion returns the major, minor and patch version of the first Go
+// version in s. Missing parts are zero, ok is false if s contains no version,
+// e.g. for development versions built from a commit.
+func parseGoVersion(s string) (v [3]int, ok bool) {
+	m := goRelease.FindStringSubmatch(s)
+	if m == nil {
+		return v, false
+	}
+
+	for i, part := range m[1:] {
+		if part != "" {
+			v[i], _ = strconv.Atoi(part)
+		}
 	}
 
-	fmt.Printf("Go version %v\n", v)
+	return v, true
+}
 
-	if !exists(repodir) {
-		err := clone("https://github.com/restic/restic", repodir)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "clone error: %v\n", err)
-			os.Exit(1)
+// olderGoVersion returns true if a is older than b.
+func olderGoVersion(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
 		}
 	}
 
-	commit, err := readCurrentCommit(commitfile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "read state file %v: %v\n", commitfile, err)
-		os.Exit(1)
+	return false
+}
+
+// checkGoVersion warns about targets which are not supported by the Go
+// version output by "go version".
+func checkGoVersion(version string, targets []BuildTarget) {
+	v, ok := parseGoVersion(version)
+	if !ok || v[0] != 1 {
+		return
 	}
 
-	for {
-		err := update(repodir)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error update: %v\n", err)
-			time.Sleep(pollInterval)
+	minor := v[1]
 
-			continue
+	for _, target := range targets {
+		if required, ok := targetMinGoVersion[target.platform()]; ok && minor < required {
+			slog.Warn("Go version does not support target, building it will fail",
+				"target", target, "required", fmt.Sprintf("go1.%d", required))
 		}
+	}
+}
+
+// checkMinGoVersion returns an error if the Go version output by "go
+// version" is older than required, e.g. "go1.21". Versions which can't be
+// parsed, like development versions, are accepted.
+func checkMinGoVersion(version, required string) error {
+	want, ok := parseGoVersion(required)
+	if !ok {
+		return fmt.Errorf("invalid minimum Go version %q", required)
+	}
+
+	have, ok := parseGoVersion(version)
+	if !ok {
+		slog.Warn("unable to parse Go version, assuming it is new enough", "version", version)
+		return nil
+	}
 
-		newCommit := commitID(repodir)
+	if olderGoVersion(have, want) {
+		return fmt.Errorf("%v is too old, at least %v is required", version, required)
+	}
+
+	return nil
+}
 
-		if commit != newCommit {
-			err = build(repodir, outputdir)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "MkdirAll(%v) failed: %v\n", outputdir, err)
-			}
+// modGoVersion returns the Go version from the go directive in the go.mod
+// file in dir, e.g. "go1.21".
+func modGoVersion(dir string) (string, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "go" {
+			return "go" + fields[1], nil
 		}
+	}
+
+	return "", fmt.Errorf("no go directive found in %v", filepath.Join(dir, "go.mod"))
+}
 
-		commit = newCommit
+// supportedTargets returns the platforms supported by the go command, as
+// listed by "go tool dist list".
+func supportedTargets() (map[string]bool, error) {
+	cmd := exec.Command(goBinary, "tool", "dist", "list")
+	cmd.Stderr = os.Stderr
 
-		err = writeCurrentCommit(commitfile, commit)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "write state file %v: %v\n", commitfile, err)
+	buf, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing supported targets failed: %w", err)
+	}
+
+	supported := make(map[string]bool)
+
+	for _, line := range strings.Fields(string(buf)) {
+		if strings.Contains(line, "/") {
+			supported[line] = true
 		}
+	}
+
+	return supported, nil
+}
+
+// validateTargets returns the targets which are in supported. The others are
+// an error, unless skipInvalid is set, then they are only logged.
+func validateTargets(targets []BuildTarget, supported map[string]bool, skipInvalid bool) ([]BuildTarget, error) {
+	var valid []BuildTarget
+	var invalid []string
+
+	for _, target := range targets {
+		// the variants are checked by the go command when building
+		if supported[target.platform()] {
+			valid = append(valid, target)
+		} else {
+			invalid = append(invalid, target.String())
+		}
+	}
+
+	if len(invalid) > 0 && !skipInvalid {
+		return nil, fmt.Errorf("unsupported targets %v, see \"go tool dist list\"", strings.Join(invalid, ", "))
+	}
 
-		time.Sleep(pollInterval)
+	if len(invalid) > 0 {
+		slog.Warn("skipping unsupported targets, see \"go tool dist list\"", "targets", strings.Join(invalid, ", "))
 	}
+
+	if len(valid) == 0 {
+		return nil, errors.New("none of the targets is supported")
+	}
+
+	return valid, nil
+}
+
+// setupLogging installs the default logger with the given level, which writes
+// either human-readable text or JSON records to stderr.
+func setupLogging(level string, json bool) error {
+	var l slog.Level
+
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+
+	var h slog.Handler
+	if json {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+
+	slog.SetDefault(slog.New(h))
+
+	return nil
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// manifestFilename is the name of the file in the version directory which
+// describes the build.
+const manifestFilename = "manifest.json"
+
+// Manifest is a machine-readable description of a build.
+type Manifest struct {
+	Commit    string     `json:"commit"`
+	Version   string     `json:"version"`
+	GoVersion string     `json:"go_version"`
+	BuildTime time.Time  `json:"build_time"`
+	Artifacts []Artifact `json:"artifacts"`
+
+	// Compress is the compression of the artifacts, which is needed to
+	// name the "latest" symlinks when a staged build is promoted.
+	Compress Compression `json:"compress,omitempty"`
+
+	// Changes lists the commits since the previous tag for builds of
+	// tags.
+	Changes *Changes `json:"changes,omitempty"`
+
+	// Source describes the archive of the source code of the commit, if
+	// one was created.
+	Source *SourceArchive `json:"source,omitempty"`
+}
+
+// Changes lists the commits since the previous release.
+type Changes struct {
+	Since string `json:"since"`
+
+	// Commits contains the abbreviated hash and the subject of each
+	// commit, newest first. Truncated is set if there were more than
+	// maxChanges.
+	Commits   []string `json:"commits"`
+	Truncated bool     `json:"truncated,omitempty"`
+}
+
+// Artifact describes a file built for a target.
+type Artifact struct {
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	Variant  string `json:"variant,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+
+	// BinarySize is the size of the binary before it was compressed.
+	BinarySize int64 `json:"binary_size,omitempty"`
+
+	// Build records how the binary was compiled.
+	Build *BuildProvenance `json:"build,omitempty"`
+}
+
+// BuildProvenance describes the environment and the command which compiled a
+// binary, on the builder or a remote worker.
+type BuildProvenance struct {
+	GoVersion string `json:"go_version"`
+
+	// Env contains the variables affecting the go command, like GOOS and
+	// CGO_ENABLED, and those set for the target.
+	Env map[string]string `json:"env"`
+
+	// Args are the arguments passed to the go command, including the
+	// build tags and the linker flags.
+	Args []string `json:"args"`
+}
+
+// target returns the target a was built for.
+func (a Artifact) target() BuildTarget {
+	return BuildTarget{OS: a.OS, Arch: a.Arch, Variant: a.Variant, Profile: a.Profile}
+}
+
+// sortArtifacts sorts artifacts by OS, architecture and file name.
+func sortArtifacts(artifacts []Artifact) {
+	sort.Slice(artifacts, func(i, j int) bool {
+		a, b := artifacts[i], artifacts[j]
+
+		if a.OS != b.OS {
+			return a.OS < b.OS
+		}
+
+		if a.Arch != b.Arch {
+			return a.Arch < b.Arch
+		}
+
+		return a.Filename < b.Filename
+	})
+}
+
+// readManifest loads the manifest from the directory dir.
+func readManifest(dir string) (Manifest, error) {
+	var m Manifest
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, manifestFilename))
+	if err != nil {
+		return m, err
+	}
+
+	err = json.Unmarshal(buf, &m)
+	return m, err
+}
+
+// writeManifest saves m as JSON in the directory dir.
+func writeManifest(dir string, m Manifest) error {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, manifestFilename), append(buf, '\n'), 0644)
+}
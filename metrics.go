@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// States of the poll loop reported by the metric beta_state.
+const (
+	stateIdle     = "idle"
+	statePolling  = "polling"
+	stateBuilding = "building"
+)
+
+var states = []string{stateIdle, statePolling, stateBuilding}
+
+var (
+	buildsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "beta_builds_total",
+		Help: "Number of builds attempted.",
+	})
+
+	buildsSucceeded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "beta_builds_succeeded_total",
+		Help: "Number of builds which were published.",
+	})
+
+	buildsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "beta_builds_failed_total",
+		Help: "Number of builds which failed.",
+	})
+
+	targetDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "beta_target_build_duration_seconds",
+		Help:    "Time needed to compile a single target.",
+		Buckets: prometheus.ExponentialBuckets(10, 2, 8),
+	}, []string{"os", "arch"})
+
+	state = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "beta_state",
+		Help: "Current state of the poll loop, the active state is 1.",
+	}, []string{"state"})
+
+	freeSpace = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "beta_output_free_bytes",
+		Help: "Space available for builds on the volume of the output directory.",
+	})
+
+	corruptFiles = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "beta_published_corrupt_files",
+		Help: "Files of the latest published builds which didn't match their checksums in the last verification.",
+	}, []string{"repo"})
+
+	memorySys = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "beta_memory_sys_bytes",
+		Help: "Memory obtained from the system by the builder, sampled during builds with -profile-resources.",
+	})
+
+	goroutines = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "beta_goroutines",
+		Help: "Number of goroutines of the builder, sampled during builds with -profile-resources.",
+	})
+)
+
+// lastSuccess is the time of the last successful build, protected by
+// lastSuccessMu.
+var (
+	lastSuccessMu sync.Mutex
+	lastSuccess   time.Time
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		buildsTotal,
+		buildsSucceeded,
+		buildsFailed,
+		targetDuration,
+		state,
+		freeSpace,
+		corruptFiles,
+		memorySys,
+		goroutines,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "beta_active_compiles",
+			Help: "Number of go build processes running.",
+		}, func() float64 {
+			return float64(activeCompiles.Load())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "beta_seconds_since_last_success",
+			Help: "Time since the last successful build, NaN if there was none yet.",
+		}, secondsSinceLastSuccess),
+	)
+
+	setState(stateIdle)
+}
+
+// metricsHandler serves the metrics in the Prometheus format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// setState records the current state of the poll loop.
+func setState(current string) {
+	for _, s := range states {
+		v := 0.0
+		if s == current {
+			v = 1
+		}
+
+		state.WithLabelValues(s).Set(v)
+	}
+}
+
+// recordBuild updates the build counters with the outcome of a build.
+func recordBuild(err error) {
+	buildsTotal.Inc()
+
+	if err != nil {
+		buildsFailed.Inc()
+		return
+	}
+
+	buildsSucceeded.Inc()
+
+	lastSuccessMu.Lock()
+	lastSuccess = time.Now()
+	lastSuccessMu.Unlock()
+}
+
+func secondsSinceLastSuccess() float64 {
+	lastSuccessMu.Lock()
+	defer lastSuccessMu.Unlock()
+
+	if lastSuccess.IsZero() {
+		return math.NaN()
+	}
+
+	return time.Since(lastSuccess).Seconds()
+}
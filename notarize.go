@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// Notary configures signing the macOS binaries and submitting them to Apple's
+// notary service, so that Gatekeeper doesn't block them.
+type Notary struct {
+	// Identity is the name of the signing certificate in the keychain, e.g.
+	// "Developer ID Application: Example (TEAMID)".
+	Identity string `json:"identity"`
+
+	// Profile is the name of the credentials for the notary service stored
+	// in the keychain with "xcrun notarytool store-credentials".
+	Profile string `json:"profile"`
+}
+
+// notarizeBinary signs the executable filename built for target and submits
+// it to the notary service, waiting for the result. Only darwin targets are
+// notarized, and only if the host is a Mac. Failures are only logged, the
+// binary is then published without.
+//
+// The ticket can't be stapled to a bare executable, stapler only supports
+// bundles, disk images and packages, so Gatekeeper looks it up online.
+func notarizeBinary(ctx context.Context, n Notary, target BuildTarget, filename string) {
+	if target.OS != "darwin" {
+		return
+	}
+
+	if runtime.GOOS != "darwin" {
+		slog.Warn("notarizing requires a macOS host, publishing the binary without", "target", target)
+		return
+	}
+
+	start := time.Now()
+
+	err := codesign(ctx, n.Identity, filename)
+	if err != nil {
+		slog.Warn("signing binary failed", "target", target, "err", err)
+		return
+	}
+
+	err = notarize(ctx, n.Profile, filename)
+	if err != nil {
+		slog.Warn("notarizing binary failed", "target", target, "err", err)
+		return
+	}
+
+	slog.Info("notarized binary", "target", target, "duration", time.Since(start))
+}
+
+// codesign signs filename with identity, the hardened runtime and a secure
+// timestamp are required for notarization.
+func codesign(ctx context.Context, identity, filename string) error {
+	cmd := exec.CommandContext(ctx, "codesign", "--force", "--options", "runtime", "--timestamp", "--sign", identity, filename)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+// notaryResult is the part of the output of "notarytool submit" used here.
+type notaryResult struct {
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// notarize submits filename to the notary service with the credentials stored
+// in the keychain as profile and waits until it has been processed.
+func notarize(ctx context.Context, profile, filename string) error {
+	// the notary service only accepts archives, disk images and packages
+	archive := filename + ".zip"
+	defer os.Remove(archive)
+
+	cmd := exec.CommandContext(ctx, "ditto", "-c", "-k", "--keepParent", filename, archive)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("creating archive failed: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	cmd = exec.CommandContext(ctx, "xcrun", "notarytool", "submit", archive,
+		"--keychain-profile", profile, "--wait", "--output-format", "json")
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err = cmd.Output()
+	if err != nil {
+		return fmt.Errorf("notarytool failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var res notaryResult
+
+	err = json.Unmarshal(out, &res)
+	if err != nil {
+		return fmt.Errorf("parsing the output of notarytool failed: %w", err)
+	}
+
+	if res.Status != "Accepted" {
+		return fmt.Errorf("submission %v was not accepted: %v: %v", res.ID, res.Status, res.Message)
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout limits the time a single webhook request may take.
+const webhookTimeout = 10 * time.Second
+
+// webhookPayload is the JSON document sent to the webhook URL.
+type webhookPayload struct {
+	Status  string `json:"status"`
+	Repo    string `json:"repo,omitempty"`
+	Branch  string `json:"branch,omitempty"`
+	Commit  string `json:"commit"`
+	Version string `json:"version,omitempty"`
+
+	// CommitURL links to the commit in the web interface of the forge, if
+	// the repository is hosted on one.
+	CommitURL string `json:"commit_url,omitempty"`
+
+	// Duration is the build duration in seconds.
+	Duration float64  `json:"duration,omitempty"`
+	Files    []string `json:"files,omitempty"`
+	Failed   []string `json:"failed,omitempty"`
+	Error    string   `json:"error,omitempty"`
+
+	// Stage is the stage in which the build failed, e.g. "build" or
+	// "publish", see failureStage.
+	Stage string `json:"stage,omitempty"`
+
+	// Vet is the output of go vet if it reported issues.
+	Vet string `json:"vet,omitempty"`
+
+	// Recovered is set for the first successful build after a failure.
+	Recovered bool `json:"recovered,omitempty"`
+
+	// Changes lists the commits since the previous tag for builds of
+	// tags.
+	Changes *Changes `json:"changes,omitempty"`
+}
+
+func newWebhookPayload(repo Repo, branch, commit string, info buildInfo, err error, recovered bool) webhookPayload {
+	p := webhookPayload{
+		Status:    "success",
+		Repo:      repo.Name,
+		Branch:    branch,
+		Commit:    commit,
+		Version:   info.Version,
+		CommitURL: repo.Remote.forge().CommitURL(commit),
+		Duration:  info.Duration.Seconds(),
+		Files:     info.Files,
+		Failed:    failedTargets(info),
+		Vet:       info.VetOutput,
+		Recovered: recovered,
+		Changes:   info.Changes,
+	}
+
+	if err != nil {
+		p.Status = "failure"
+		p.Error = err.Error()
+		p.Stage = failureStage(err)
+	}
+
+	return p
+}
+
+// buildName returns the name of the builds of branch of repo used in
+// notifications.
+func buildName(repo, branch string) string {
+	name := "restic beta"
+	if repo != "" {
+		name = repo + " beta"
+	}
+
+	if branch != "" {
+		name += " (" + branch + ")"
+	}
+
+	return name
+}
+
+// notifyWebhook sends payload as JSON to url, formatted for the webhook type
+// kind. The request is retried once if the server responds with a 5xx status
+// code or cannot be reached.
+func notifyWebhook(url, kind string, payload webhookPayload) error {
+	var body any = payload
+
+	switch kind {
+	case webhookSlack:
+		body = slackBody(newChatMessage(payload))
+	case webhookDiscord:
+		body = discordBody(newChatMessage(payload))
+	}
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+
+	retry, err := postJSON(client, url, buf)
+	if retry {
+		slog.Warn("webhook failed, retrying", "err", err)
+		time.Sleep(time.Second)
+
+		_, err = postJSON(client, url, buf)
+	}
+
+	return err
+}
+
+// postJSON sends buf to url. It reports whether a failed request should be
+// retried.
+func postJSON(client *http.Client, url string, buf []byte) (retry bool, err error) {
+	res, err := client.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return true, err
+	}
+
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	_ = res.Body.Close()
+
+	if res.StatusCode >= 500 {
+		return true, fmt.Errorf("webhook returned status %v", res.Status)
+	}
+
+	if res.StatusCode >= 300 {
+		return false, fmt.Errorf("webhook returned status %v", res.Status)
+	}
+
+	return false, nil
+}
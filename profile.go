@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// defaultProfile is the name of the profile configured with the flags, its
+// binaries are stored in the version directory itself.
+const defaultProfile = "release"
+
+// BuildProfile is an additional flavor of the binaries, e.g. a debug build.
+// Each target is also built with each profile into the subdirectory named
+// after it.
+type BuildProfile struct {
+	Name string `json:"name"`
+
+	// LDFlags is appended to the linker flags configured with -ldflags,
+	// GCFlags is passed to the compiler.
+	LDFlags string `json:"ldflags,omitempty"`
+	GCFlags string `json:"gcflags,omitempty"`
+
+	// Tags lists the build tags.
+	Tags []string `json:"tags,omitempty"`
+
+	// Strip removes the debug information, unlike with the default
+	// profile it is off unless set.
+	Strip bool `json:"strip,omitempty"`
+}
+
+// loadProfiles reads the list of profiles from the JSON file filename.
+func loadProfiles(filename string) ([]BuildProfile, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []BuildProfile
+
+	err = json.Unmarshal(buf, &list)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %v failed: %w", filename, err)
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no profiles listed in %v", filename)
+	}
+
+	used := make(map[string]bool, len(list))
+
+	for _, p := range list {
+		switch {
+		case p.Name == defaultProfile:
+			return nil, fmt.Errorf("profile %q is configured with the flags", p.Name)
+		case p.Name == "" || strings.ContainsAny(p.Name, `/\+. `):
+			return nil, fmt.Errorf("invalid profile name %q", p.Name)
+		}
+
+		if used[p.Name] {
+			return nil, fmt.Errorf("profile %q is listed twice", p.Name)
+		}
+
+		used[p.Name] = true
+	}
+
+	return list, nil
+}
+
+// expandProfiles returns targets, followed by each of them for each of the
+// profiles.
+func expandProfiles(targets []BuildTarget, profiles []BuildProfile) []BuildTarget {
+	all := append([]BuildTarget(nil), targets...)
+
+	for _, p := range profiles {
+		for _, target := range targets {
+			target.Profile = p.Name
+			all = append(all, target)
+		}
+	}
+
+	return all
+}
+
+// buildArgs returns the arguments for go build writing the binary for the
+// target of j to output, extra is passed in addition to j.BuildArgs.
+func (j job) buildArgs(output string, extra ...string) []string {
+	pkg := j.Package
+	if pkg == "" {
+		pkg = defaultPackage
+	}
+
+	p, ok := j.Profiles[j.Target.Profile]
+	if !ok {
+		return goBuildArgs(pkg, output, j.LDFlags, j.Strip, append(extra, j.BuildArgs...))
+	}
+
+	ldflags := strings.TrimSpace(j.LDFlags + " " + p.LDFlags)
+	extra = append(extra, j.BuildArgs...)
+
+	if p.GCFlags != "" {
+		extra = append(extra, "-gcflags", p.GCFlags)
+	}
+
+	if len(p.Tags) > 0 {
+		extra = append(extra, "-tags", strings.Join(p.Tags, ","))
+	}
+
+	return goBuildArgs(pkg, output, ldflags, p.Strip, extra)
+}
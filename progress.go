@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// buildResult is the outcome of building a single target.
+type buildResult struct {
+	Target   BuildTarget
+	Artifact Artifact
+	Duration time.Duration
+	Err      error
+}
+
+// interactive returns true if stderr is a terminal.
+func interactive() bool {
+	fi, err := os.Stderr.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// printProgress shows how many of the targets are done on a single line.
+func printProgress(w io.Writer, done, total int) {
+	fmt.Fprintf(w, "\rbuilding %d/%d", done, total)
+	if done == total {
+		fmt.Fprintln(w)
+	}
+}
+
+// printTargets writes a table with the targets and the names of their files.
+func printTargets(w io.Writer, targets []BuildTarget, filenames map[string]string, compress Compression) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tFILE")
+
+	for _, target := range targets {
+		fmt.Fprintf(tw, "%v\t%v\n", target, filenames[target.String()]+compress.Ext())
+	}
+
+	_ = tw.Flush()
+}
+
+// printSummary writes a table with the result for each of the targets,
+// targets without a result are listed as skipped. The sizes are compared to
+// the previous version.
+func printSummary(w io.Writer, targets []BuildTarget, results []buildResult, sizes map[string]sizeChange) {
+	byTarget := make(map[string]buildResult, len(results))
+	for _, res := range results {
+		byTarget[res.Target.String()] = res
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tSTATUS\tDURATION\tSIZE\tCHANGE")
+
+	for _, target := range targets {
+		res, ok := byTarget[target.String()]
+
+		switch {
+		case !ok:
+			fmt.Fprintf(tw, "%v\tskipped\t-\t-\t-\n", target)
+		case res.Err != nil:
+			fmt.Fprintf(tw, "%v\tfailed\t%v\t-\t-\n", target, formatDuration(res.Duration))
+		default:
+			fmt.Fprintf(tw, "%v\tok\t%v\t%v\t%v\n", target, formatDuration(res.Duration),
+				formatSize(res.Artifact.Size), formatGrowth(sizes[target.String()]))
+		}
+	}
+
+	_ = tw.Flush()
+}
+
+// formatGrowth returns the change of the size in percent, e.g. "+1.2%".
+func formatGrowth(c sizeChange) string {
+	if c.Previous == 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("%+.1f%%", c.growth())
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+
+	return d.Round(100 * time.Millisecond).String()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// pruneOldBuilds removes all but the newest keep version directories in
+// outputdir. The directory the "latest" symlink points to is never removed.
+// The logs of failed builds are pruned the same way, and with the content
+// layout, the objects which are no longer used are removed as well.
+func pruneOldBuilds(outputdir string, keep int) error {
+	latest, err := readLatest(outputdir)
+	if err != nil {
+		return fmt.Errorf("read latest failed: %w", err)
+	}
+
+	err = pruneDirs(outputdir, keep, latest, "removing old build")
+	if err != nil {
+		return err
+	}
+
+	err = pruneDirs(filepath.Join(outputdir, failedDirname), keep, "", "removing logs of old failed build")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// objects are only still used by the remaining versions
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	return pruneObjects(outputdir)
+}
+
+// pruneDirs removes all but the newest keep version directories in dir, except
+// for the one named latest.
+func pruneDirs(dir string, keep int, latest, msg string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("list output dir failed: %w", err)
+	}
+
+	var dirs []os.FileInfo
+
+	for _, fi := range entries {
+		if !fi.IsDir() || !strings.HasPrefix(fi.Name(), "restic-") {
+			continue
+		}
+
+		dirs = append(dirs, fi)
+	}
+
+	if len(dirs) <= keep {
+		return nil
+	}
+
+	// sort newest first
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].ModTime().After(dirs[j].ModTime())
+	})
+
+	for _, fi := range dirs[keep:] {
+		if fi.Name() == latest {
+			continue
+		}
+
+		slog.Info(msg, "dir", fi.Name())
+
+		err := os.RemoveAll(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return fmt.Errorf("remove old build failed: %w", err)
+		}
+	}
+
+	return nil
+}
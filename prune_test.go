@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPruneOldBuilds(t *testing.T) {
+	outputdir := t.TempDir()
+	now := time.Now()
+
+	dirs := []string{
+		"restic-v0.1.0",
+		"restic-v0.2.0",
+		"restic-v0.3.0",
+		failedDirname + "/restic-v0.4.0",
+		failedDirname + "/restic-v0.5.0",
+		failedDirname + "/restic-v0.6.0",
+	}
+
+	for i, dir := range dirs {
+		dir = filepath.Join(outputdir, filepath.FromSlash(dir))
+
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mtime := now.Add(time.Duration(i) * time.Minute)
+
+		err = os.Chtimes(dir, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the oldest version is kept because it is the latest one
+	err := updateLatest(outputdir, "restic-v0.1.0", "v0.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pruneOldBuilds(outputdir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var left []string
+
+	for _, pattern := range []string{"restic-*", failedDirname + "/restic-*"} {
+		matches, err := filepath.Glob(filepath.Join(outputdir, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, m := range matches {
+			rel, _ := filepath.Rel(outputdir, m)
+			left = append(left, filepath.ToSlash(rel))
+		}
+	}
+
+	sort.Strings(left)
+
+	want := []string{failedDirname + "/restic-v0.6.0", "restic-v0.1.0", "restic-v0.3.0"}
+
+	if len(left) != len(want) {
+		t.Fatalf("left %v, want %v", left, want)
+	}
+
+	for i := range want {
+		if left[i] != want[i] {
+			t.Fatalf("left %v, want %v", left, want)
+		}
+	}
+}
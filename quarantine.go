@@ -0,0 +1,128 @@
+package main
+
+import (
+	"time"
+)
+
+// quarantined returns the names of the targets of branch which are skipped
+// because they failed too often. Targets are retried once cooldown has
+// elapsed since they were quarantined, zero keeps them quarantined until they
+// are reset.
+func (s *State) quarantined(branch string, cooldown time.Duration) map[string]bool {
+	bs, ok := s.Branches[branch]
+	if !ok {
+		return nil
+	}
+
+	skip := make(map[string]bool)
+
+	for target, since := range bs.Quarantined {
+		if cooldown > 0 && time.Since(since) >= cooldown {
+			continue
+		}
+
+		skip[target] = true
+	}
+
+	return skip
+}
+
+// recordTargets updates the consecutive failures of the targets built for
+// branch. Targets which failed n times in a row are quarantined, the names of
+// the newly quarantined targets are returned.
+func (s *State) recordTargets(branch string, info buildInfo, n int) []string {
+	bs, ok := s.Branches[branch]
+	if !ok {
+		bs = &BranchState{}
+		s.Branches[branch] = bs
+	}
+
+	for _, target := range info.Built {
+		delete(bs.Failures, target.String())
+		delete(bs.Quarantined, target.String())
+	}
+
+	var added []string
+
+	for target := range info.Failed {
+		if bs.Failures == nil {
+			bs.Failures = make(map[string]int)
+		}
+
+		bs.Failures[target]++
+
+		if bs.Failures[target] < n {
+			continue
+		}
+
+		if bs.Quarantined == nil {
+			bs.Quarantined = make(map[string]time.Time)
+		}
+
+		// a target retried after the cooldown is quarantined again
+		bs.Quarantined[target] = time.Now()
+		added = append(added, target)
+	}
+
+	return added
+}
+
+// resetQuarantine forgets the failures of all targets, so that quarantined
+// targets are built again. It returns the number of targets released.
+func (s *State) resetQuarantine() int {
+	n := 0
+
+	for _, bs := range s.Branches {
+		n += len(bs.Quarantined)
+		bs.Failures = nil
+		bs.Quarantined = nil
+	}
+
+	return n
+}
+
+// skipQuarantined returns cfg without the targets quarantined for branch. If
+// all targets are quarantined, they are built anyway.
+func (d *daemon) skipQuarantined(branch string, cfg Config) Config {
+	if cfg.QuarantineAfter <= 0 {
+		return cfg
+	}
+
+	skip := d.state.quarantined(branch, cfg.QuarantineCooldown)
+	if len(skip) == 0 {
+		return cfg
+	}
+
+	var targets []BuildTarget
+
+	for _, target := range cfg.Targets {
+		if skip[target.String()] {
+			d.log.Debug("skipping quarantined target", "branch", branch, "target", target)
+			continue
+		}
+
+		targets = append(targets, target)
+	}
+
+	if len(targets) == 0 {
+		d.log.Warn("all targets are quarantined, building them anyway", "branch", branch)
+		return cfg
+	}
+
+	cfg.Targets = targets
+
+	return cfg
+}
+
+// recordTargets updates the failures of the targets in info and logs the
+// targets which are quarantined from now on.
+func (d *daemon) recordTargets(branch string, info buildInfo) {
+	if d.cfg.QuarantineAfter <= 0 {
+		return
+	}
+
+	for _, target := range d.state.recordTargets(branch, info, d.cfg.QuarantineAfter) {
+		d.log.Warn("target quarantined after consecutive failures", "branch", branch, "target", target,
+			"failures", d.state.Branches[branch].Failures[target], "cooldown", d.cfg.QuarantineCooldown)
+	}
+}
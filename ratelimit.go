@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+// rateWindow is the period in which at most cfg.MaxBuildsPerHour builds are
+// started.
+const rateWindow = time.Hour
+
+// recentBuilds removes the build times older than rateWindow from the state and
+// returns the remaining ones, oldest first.
+func (s *State) recentBuilds(now time.Time) []time.Time {
+	recent := s.BuildTimes[:0]
+
+	for _, t := range s.BuildTimes {
+		if now.Sub(t) < rateWindow {
+			recent = append(recent, t)
+		}
+	}
+
+	s.BuildTimes = recent
+
+	return recent
+}
+
+// addBuildTime records that a build was started at t.
+func (s *State) addBuildTime(t time.Time) {
+	s.BuildTimes = append(s.recentBuilds(t), t)
+}
+
+// buildAllowed reports whether another build may be started without exceeding
+// cfg.MaxBuildsPerHour. If not, the deferred build described by args is
+// logged together with the time the next one is allowed.
+func (d *daemon) buildAllowed(args ...any) bool {
+	limit := d.cfg.MaxBuildsPerHour
+	if limit <= 0 {
+		return true
+	}
+
+	recent := d.state.recentBuilds(time.Now())
+	if len(recent) < limit {
+		return true
+	}
+
+	next := recent[len(recent)-limit].Add(rateWindow)
+	args = append(args, "builds", len(recent), "limit", limit, "next", next.Round(time.Second), "forced", d.forcing)
+	d.log.Info("build deferred by rate limit", args...)
+
+	return false
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Repo is a repository whose commits are built. Each repository has its own
+// clone, output directory and state.
+type Repo struct {
+	// Name identifies the repository in logs, notifications and object
+	// names on S3. It is empty for the repository configured with the
+	// flags.
+	Name string
+
+	Remote Remote
+
+	// Dir is the clone of the repository.
+	Dir string
+
+	// OutputDir receives the builds of the checked out branch, the builds
+	// of Branches are written to subdirectories.
+	OutputDir string
+
+	// StateFile holds the State of the repository, HistoryFile the
+	// durations of the recent builds.
+	StateFile   string
+	HistoryFile string
+
+	// Branches lists the branches which are built into separate
+	// subdirectories of OutputDir. If empty, the checked out branch is
+	// pulled and built.
+	Branches []string
+}
+
+// defaultRepo returns the repository used if no list of repositories is
+// configured, it is located at the paths used by earlier versions.
+func defaultRepo(remote Remote) Repo {
+	return Repo{
+		Remote:      remote,
+		Dir:         defaultRepoDir,
+		OutputDir:   defaultOutputDir,
+		StateFile:   defaultStateFile,
+		HistoryFile: defaultHistoryFile,
+	}
+}
+
+// outputdirFor returns the directory the builds for branch are published in.
+func (r Repo) outputdirFor(branch string) string {
+	return filepath.Join(r.OutputDir, branchDirname(branch))
+}
+
+// branchDirname returns the subdirectory the builds for branch are published
+// in, relative to the output directory.
+func branchDirname(branch string) string {
+	if branch == tagBranch {
+		return tagDirname
+	}
+
+	return branch
+}
+
+// repoConfig is an entry in the file read by loadRepos.
+type repoConfig struct {
+	Name        string   `json:"name"`
+	URL         string   `json:"url"`
+	Forge       string   `json:"forge"`
+	Dir         string   `json:"dir"`
+	OutputDir   string   `json:"output_dir"`
+	StateFile   string   `json:"state_file"`
+	HistoryFile string   `json:"history_file"`
+	Branches    []string `json:"branches"`
+}
+
+// loadRepos reads the list of repositories from the JSON file filename. The
+// credentials and the shallow setting are taken from remote, like the forge
+// unless it is set. Unset paths default to locations derived from the name.
+func loadRepos(filename string, remote Remote) ([]Repo, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []repoConfig
+
+	err = json.Unmarshal(buf, &list)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %v failed: %w", filename, err)
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no repositories listed in %v", filename)
+	}
+
+	var repos []Repo
+
+	used := make(map[string]bool)
+
+	for _, rc := range list {
+		if rc.Name == "" || strings.ContainsAny(rc.Name, `/\`) {
+			return nil, fmt.Errorf("invalid repository name %q", rc.Name)
+		}
+
+		if rc.URL == "" {
+			return nil, fmt.Errorf("repository %v has no url", rc.Name)
+		}
+
+		r := Repo{
+			Name:        rc.Name,
+			Remote:      remote,
+			Dir:         rc.Dir,
+			OutputDir:   rc.OutputDir,
+			StateFile:   rc.StateFile,
+			HistoryFile: rc.HistoryFile,
+			Branches:    rc.Branches,
+		}
+
+		r.Remote.URL = rc.URL
+
+		if rc.Forge != "" {
+			err = validForge(rc.Forge)
+			if err != nil {
+				return nil, fmt.Errorf("repository %v: %w", rc.Name, err)
+			}
+
+			r.Remote.Forge = rc.Forge
+		}
+
+		if r.Dir == "" {
+			r.Dir = rc.Name + ".git"
+		}
+
+		if r.OutputDir == "" {
+			r.OutputDir = filepath.Join(defaultOutputDir, rc.Name)
+		}
+
+		if r.StateFile == "" {
+			r.StateFile = "state." + rc.Name + ".json"
+		}
+
+		if r.HistoryFile == "" {
+			r.HistoryFile = "history." + rc.Name + ".jsonl"
+		}
+
+		// the repositories must not overwrite each other
+		for _, key := range []string{"name " + r.Name, "dir " + r.Dir, "output dir " + r.OutputDir, "state file " + r.StateFile, "history file " + r.HistoryFile} {
+			if used[key] {
+				return nil, fmt.Errorf("%v is used for more than one repository", key)
+			}
+
+			used[key] = true
+		}
+
+		repos = append(repos, r)
+	}
+
+	return repos, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log/slog"
+	"os/exec"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// The resource usage is sampled every resourceSampleInterval during a build
+// with -profile-resources, for recording the peak values, and logged every
+// resourceInterval.
+const (
+	resourceSampleInterval = time.Second
+	resourceInterval       = 10 * time.Second
+)
+
+// activeCompiles is the number of go build processes currently running.
+var activeCompiles atomic.Int64
+
+// runCompile runs the go build command cmd, which is counted in
+// activeCompiles while it runs.
+func runCompile(cmd *exec.Cmd) error {
+	activeCompiles.Add(1)
+	defer activeCompiles.Add(-1)
+
+	return cmd.Run()
+}
+
+// resourceSample is the resource usage at a point in time. Sys is the memory
+// obtained from the system by the builder itself, which is an upper bound for
+// its resident set, the compilers are separate processes.
+type resourceSample struct {
+	Sys        uint64
+	Heap       uint64
+	Goroutines int
+	Compiles   int64
+}
+
+func sampleResources() resourceSample {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	return resourceSample{
+		Sys:        m.Sys,
+		Heap:       m.HeapAlloc,
+		Goroutines: runtime.NumGoroutine(),
+		Compiles:   activeCompiles.Load(),
+	}
+}
+
+// profileResources samples, logs and records the resource usage during the
+// build of version until the returned function is called, which logs the peak
+// values.
+func profileResources(version string) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	start := time.Now()
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(resourceSampleInterval)
+		defer ticker.Stop()
+
+		var peak resourceSample
+
+		record := func() resourceSample {
+			s := sampleResources()
+
+			peak.Sys = max(peak.Sys, s.Sys)
+			peak.Heap = max(peak.Heap, s.Heap)
+			peak.Goroutines = max(peak.Goroutines, s.Goroutines)
+			peak.Compiles = max(peak.Compiles, s.Compiles)
+
+			memorySys.Set(float64(s.Sys))
+			goroutines.Set(float64(s.Goroutines))
+
+			return s
+		}
+
+		record()
+		logged := start
+
+		for {
+			select {
+			case <-ticker.C:
+				s := record()
+				if time.Since(logged) < resourceInterval {
+					continue
+				}
+
+				logged = time.Now()
+				slog.Info("resource usage", "version", version, "sys", formatSize(int64(s.Sys)), "heap", formatSize(int64(s.Heap)),
+					"goroutines", s.Goroutines, "compiles", s.Compiles)
+			case <-done:
+				record()
+				slog.Info("peak resource usage", "version", version, "duration", time.Since(start), "sys", formatSize(int64(peak.Sys)),
+					"heap", formatSize(int64(peak.Heap)), "goroutines", peak.Goroutines, "compiles", peak.Compiles)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// resultsFilename is the name of the file in the build directory which records
+// the targets built successfully, so that they aren't compiled again when the
+// build of the same commit is interrupted or fails for other targets.
+const resultsFilename = ".results.json"
+
+// buildResults is the content of the results file.
+type buildResults struct {
+	Commit string `json:"commit"`
+
+	// Settings describes the options which affect the binaries, the results
+	// are discarded if they change.
+	Settings string `json:"settings"`
+
+	// Targets maps the names of the targets to their artifact.
+	Targets map[string]cachedResult `json:"targets"`
+}
+
+type cachedResult struct {
+	Artifact Artifact      `json:"artifact"`
+	Duration time.Duration `json:"duration"`
+}
+
+// buildSettings returns the description of the options in cfg which affect the
+// binaries built with ldflags by the Go version goVer.
+func buildSettings(cfg Config, ldflags, goVer string) string {
+	return fmt.Sprintf("go=%v package=%v ldflags=%q strip=%v upx=%v notary=%+v compress=%v reproducible=%v args=%q cgo=%v winres=%+v profiles=%+v",
+		goVer, cfg.Package, ldflags, cfg.Strip, cfg.UPX, cfg.Notary, cfg.Compress, cfg.Reproducible, cfg.BuildArgs, cfg.CGO, cfg.WindowsResources, cfg.Profiles)
+}
+
+// loadResults returns the targets recorded in dir which were built for commit
+// with settings and whose artifact still exists with the expected file name.
+// Any problem with the file just means that nothing can be reused.
+func loadResults(dir, commit, settings string, filenames map[string]string) map[string]cachedResult {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, resultsFilename))
+	if err != nil {
+		return nil
+	}
+
+	var res buildResults
+
+	err = json.Unmarshal(buf, &res)
+	if err != nil || res.Commit != commit || res.Settings != settings {
+		return nil
+	}
+
+	valid := make(map[string]cachedResult)
+
+	for name, r := range res.Targets {
+		if r.Artifact.Filename != filenames[name] {
+			continue
+		}
+
+		sum, err := sha256File(filepath.Join(dir, r.Artifact.Filename))
+		if err != nil || sum != r.Artifact.SHA256 {
+			continue
+		}
+
+		valid[name] = r
+	}
+
+	return valid
+}
+
+// saveResults writes the targets built so far to the results file in dir.
+func saveResults(dir string, res buildResults) error {
+	buf, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAndRename(filepath.Join(dir, resultsFilename), buf, 0644)
+}
+
+// removeStaleBuilds removes the build directories in outputdir left behind by
+// failed builds of other versions than the one built in keep.
+func removeStaleBuilds(outputdir, keep string) {
+	dirs, err := filepath.Glob(filepath.Join(outputdir, ".tmp-restic-*"))
+	if err != nil {
+		return
+	}
+
+	for _, dir := range dirs {
+		if dir == keep {
+			continue
+		}
+
+		slog.Debug("removing old build dir", "dir", dir)
+
+		err = os.RemoveAll(dir)
+		if err != nil {
+			slog.Warn("remove old build dir failed", "dir", dir, "err", err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+// permanentError marks an error which cannot be fixed by retrying.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// isPermanent reports whether err (or any error it wraps) is permanent.
+func isPermanent(err error) bool {
+	var perr permanentError
+	return errors.As(err, &perr)
+}
+
+// retryBaseDelay is the delay before the first retry, it doubles with each
+// attempt up to retryMaxDelay.
+const (
+	retryBaseDelay = 5 * time.Second
+	retryMaxDelay  = 5 * time.Minute
+)
+
+// backoff returns the delay before retry number n (starting at zero), with up
+// to 50% random jitter added. The result never exceeds retryMaxDelay.
+func backoff(n int) time.Duration {
+	d := retryBaseDelay << uint(n)
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+
+	d += time.Duration(rand.Int63n(int64(d)/2 + 1))
+	if d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+
+	return d
+}
+
+// jitter returns d changed by a random amount between -spread and +spread,
+// but no less than min.
+func jitter(d, spread, min time.Duration) time.Duration {
+	if spread > 0 {
+		d += time.Duration(rand.Int63n(2*int64(spread)+1)) - spread
+	}
+
+	if d < min {
+		d = min
+	}
+
+	return d
+}
+
+// retry runs fn up to attempts times until it succeeds, sleeping with an
+// exponential backoff between the attempts. It returns early for permanent
+// errors and when ctx is canceled.
+func retry(ctx context.Context, attempts int, fn func() error) error {
+	var err error
+
+	for i := 0; i < attempts; i++ {
+		err = fn()
+		if err == nil || isPermanent(err) || ctx.Err() != nil || i == attempts-1 {
+			break
+		}
+
+		d := backoff(i)
+		slog.Warn("operation failed, retrying", "err", err, "delay", d, "attempt", i+1)
+
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return err
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// SignConfig selects the tool and key used for signing the checksums file.
+type SignConfig struct {
+	// Tool is either "gpg" or "minisign".
+	Tool string
+
+	// Key is the key ID for gpg, or the file containing the secret key for
+	// minisign. The key must be usable without entering a passphrase, e.g.
+	// via a gpg agent or an unencrypted minisign key.
+	Key string
+}
+
+// signatureExt returns the extension appended to the name of the signed file.
+func (cfg SignConfig) signatureExt() string {
+	if cfg.Tool == "minisign" {
+		return ".minisig"
+	}
+
+	return ".asc"
+}
+
+func (cfg SignConfig) command(ctx context.Context, filename, sigfile string) (*exec.Cmd, error) {
+	switch cfg.Tool {
+	case "gpg":
+		return exec.CommandContext(ctx, "gpg", "--batch", "--yes", "--armor",
+			"--local-user", cfg.Key, "--output", sigfile, "--detach-sign", filename), nil
+	case "minisign":
+		return exec.CommandContext(ctx, "minisign", "-S", "-s", cfg.Key,
+			"-x", sigfile, "-m", filename), nil
+	}
+
+	return nil, fmt.Errorf("unknown signing tool %q", cfg.Tool)
+}
+
+// sign creates a detached signature for the file name in dir and returns the
+// name of the signature file. Signing the checksums file is enough to verify
+// all binaries, and much cheaper than signing each of them.
+func sign(ctx context.Context, cfg SignConfig, dir, name string) (string, error) {
+	signame := name + cfg.signatureExt()
+
+	cmd, err := cfg.command(ctx, filepath.Join(dir, name), filepath.Join(dir, signame))
+	if err != nil {
+		return "", err
+	}
+
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("signing %v with %v failed: %w", name, cfg.Tool, err)
+	}
+
+	return signame, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// sizeChange compares the size of a binary to the one of the previous version.
+type sizeChange struct {
+	Size     int64 `json:"size"`
+	Previous int64 `json:"previous,omitempty"`
+}
+
+// growth returns the change of the size relative to the previous version in
+// percent, it is zero if the previous size is unknown.
+func (c sizeChange) growth() float64 {
+	if c.Previous == 0 {
+		return 0
+	}
+
+	return float64(c.Size-c.Previous) / float64(c.Previous) * 100
+}
+
+// binarySize returns the size of the uncompressed binary, or zero if it is
+// unknown.
+func (a Artifact) binarySize() int64 {
+	if a.BinarySize > 0 {
+		return a.BinarySize
+	}
+
+	// manifests written by earlier versions only contain the size of the
+	// published file
+	for _, c := range []Compression{CompressGzip, CompressBzip2} {
+		if strings.HasSuffix(a.Filename, c.Ext()) {
+			return 0
+		}
+	}
+
+	return a.Size
+}
+
+// previousSizes returns the sizes of the binaries of the version published last
+// in outputdir, keyed by the names of the targets.
+func previousSizes(outputdir string) map[string]int64 {
+	sizes := make(map[string]int64)
+
+	latest, err := readLatest(outputdir)
+	if err != nil || latest == "" {
+		return sizes
+	}
+
+	m, err := readManifest(filepath.Join(outputdir, latest))
+	if err != nil {
+		slog.Debug("unable to read previous manifest", "dir", latest, "err", err)
+		return sizes
+	}
+
+	for _, a := range m.Artifacts {
+		if size := a.binarySize(); size > 0 {
+			sizes[a.target().String()] = size
+		}
+	}
+
+	return sizes
+}
+
+// compareSizes fills in info.Sizes from the artifacts and the sizes of the
+// previous version and warns about binaries which grew by more than
+// maxGrowth percent. A maxGrowth of zero disables the warning.
+func compareSizes(info *buildInfo, previous map[string]int64, maxGrowth float64) {
+	info.Sizes = make(map[string]sizeChange, len(info.Artifacts))
+
+	for _, a := range info.Artifacts {
+		name := a.target().String()
+		c := sizeChange{Size: a.binarySize(), Previous: previous[name]}
+		info.Sizes[name] = c
+
+		if maxGrowth > 0 && c.growth() > maxGrowth {
+			slog.Warn("binary grew more than expected", "version", info.Version, "target", name,
+				"size", c.Size, "previous", c.Previous, "growth", formatGrowth(c))
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestSizeChangeGrowth(t *testing.T) {
+	tests := []struct {
+		change sizeChange
+		want   float64
+	}{
+		{sizeChange{Size: 1000}, 0},
+		{sizeChange{Size: 1000, Previous: 1000}, 0},
+		{sizeChange{Size: 1100, Previous: 1000}, 10},
+		{sizeChange{Size: 750, Previous: 1000}, -25},
+		{sizeChange{Size: 3000, Previous: 1000}, 200},
+	}
+
+	for _, test := range tests {
+		if got := test.change.growth(); got != test.want {
+			t.Errorf("growth of %+v = %v, want %v", test.change, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// SourceArchive describes the archive of the source code the binaries of a
+// build were compiled from.
+type SourceArchive struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// sourceFilename returns the name of the source archive of version, the bundle
+// of the binaries already uses the name restic releases use for the source.
+func sourceFilename(version string) string {
+	return fmt.Sprintf("restic-%v-source.tar.gz", version)
+}
+
+// writeSourceArchive creates the source archive of commit in repodir in dir
+// with git archive. Like in restic's releases, the files are contained in a
+// directory named after the version. Untracked files, like the resources
+// generated for Windows, are not included.
+func writeSourceArchive(ctx context.Context, repodir, dir, version, commit string) (SourceArchive, error) {
+	filename, err := filepath.Abs(filepath.Join(dir, sourceFilename(version)))
+	if err != nil {
+		return SourceArchive{}, err
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "archive", "--format=tar.gz",
+		"--prefix=restic-"+version+"/", "--output="+filename, commit)
+	cmd.Dir = repodir
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		_ = os.Remove(filename)
+		return SourceArchive{}, fmt.Errorf("git archive failed: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return SourceArchive{}, err
+	}
+
+	sum, err := sha256File(filename)
+	if err != nil {
+		return SourceArchive{}, err
+	}
+
+	return SourceArchive{Filename: filepath.Base(filename), Size: fi.Size(), SHA256: sum}, nil
+}
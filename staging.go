@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// stagingDirname is the subdirectory of the output directory of a branch
+// which receives the builds with -staging until they are promoted.
+const stagingDirname = "staging"
+
+// publishMu serializes publishing builds in the local file system, so that a
+// promotion doesn't interfere with a build published at the same time.
+var publishMu sync.Mutex
+
+// publishdirFor returns the directory new builds for branch are published
+// in, which is the staging area with d.cfg.Staging.
+func (d *daemon) publishdirFor(branch string) string {
+	if d.cfg.Staging {
+		return filepath.Join(d.repo.outputdirFor(branch), stagingDirname)
+	}
+
+	return d.repo.outputdirFor(branch)
+}
+
+// promote publishes the build of version from the staging area of outputdir
+// in outputdir, or the build the staging area's "latest" symlink points to
+// if version is empty. The files are hardlinked, so the staged build remains
+// available. Builds whose files don't match the manifest are rejected. It
+// returns the name of the version directory.
+func promote(outputdir, version string) (string, error) {
+	staging := filepath.Join(outputdir, stagingDirname)
+
+	if version != "" {
+		_, err := checkVersion(version)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	versiondir := "restic-" + version
+	if version == "" {
+		latest, err := readLatest(staging)
+		if err != nil {
+			return "", err
+		}
+
+		if latest == "" {
+			return "", fmt.Errorf("no build in %v", staging)
+		}
+
+		versiondir = latest
+	}
+
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	src := filepath.Join(staging, versiondir)
+
+	m, corrupt, err := verifyArtifacts(src)
+	if err != nil {
+		return "", err
+	}
+
+	if len(corrupt) > 0 {
+		return "", fmt.Errorf("files of %v don't match their checksums: %v", versiondir, corrupt)
+	}
+
+	tmp := filepath.Join(outputdir, ".tmp-promote-"+versiondir)
+
+	err = os.RemoveAll(tmp)
+	if err == nil {
+		err = linkTree(src, tmp)
+	}
+
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return "", fmt.Errorf("linking %v failed: %w", versiondir, err)
+	}
+
+	info := buildInfo{Version: m.Version, Artifacts: m.Artifacts, Compress: m.Compress}
+
+	err = localBackend{outputdir: outputdir}.publish(tmp, info)
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return "", err
+	}
+
+	slog.Info("promoted build", "dir", outputdir, "version", m.Version)
+
+	return versiondir, nil
+}
+
+// linkTree recreates the directory tree src in dst with hardlinks to the
+// files in src.
+func linkTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case entry.IsDir():
+			return os.Mkdir(target, 0755)
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			return os.Symlink(link, target)
+		}
+
+		return os.Link(path, target)
+	})
+}
+
+// promoteAndIndex promotes version in outputdir, then prunes old builds if
+// keep is positive and renders the index with tmpl.
+func promoteAndIndex(outputdir, version string, keep int, tmpl *htmltemplate.Template) (string, error) {
+	versiondir, err := promote(outputdir, version)
+	if err != nil {
+		return "", err
+	}
+
+	if keep > 0 {
+		err = pruneOldBuilds(outputdir, keep)
+		if err != nil {
+			return versiondir, fmt.Errorf("prune old builds failed: %w", err)
+		}
+	}
+
+	return versiondir, writeIndex(outputdir, tmpl)
+}
+
+// promoteHandler serves POST /promote, which promotes the latest staged build
+// of a branch, selected with the parameter "branch", or the one given with
+// "version". With several repositories, "repo" selects one.
+type promoteHandler struct {
+	daemons []*daemon
+	token   string
+}
+
+func (h promoteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, h.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("repo")
+
+	var d *daemon
+	for _, candidate := range h.daemons {
+		if candidate.repo.Name == name || len(h.daemons) == 1 && name == "" {
+			d = candidate
+		}
+	}
+
+	if d == nil {
+		http.Error(w, "unknown repo", http.StatusNotFound)
+		return
+	}
+
+	branch := r.URL.Query().Get("branch")
+	if !d.hasBranch(branch) {
+		http.Error(w, "unknown branch", http.StatusNotFound)
+		return
+	}
+
+	version := r.URL.Query().Get("version")
+	if version != "" && !validVersion.MatchString(version) {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("promotion requested", "repo", name, "branch", branch, "version", version, "remote", r.RemoteAddr)
+
+	versiondir, err := promoteAndIndex(d.repo.outputdirFor(branch), version, d.cfg.Keep, d.cfg.Index)
+	if err != nil {
+		d.log.Error("promotion failed", "branch", branch, "version", version, "err", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"promoted": versiondir})
+}
+
+// hasBranch reports whether the builds for branch are published by d, the tag
+// builds are selected with tagDirname.
+func (d *daemon) hasBranch(branch string) bool {
+	if branch == tagDirname && d.cfg.TagPattern != "" {
+		return true
+	}
+
+	if len(d.repo.Branches) == 0 {
+		return branch == ""
+	}
+
+	for _, b := range d.repo.Branches {
+		if b == branch {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPromoteHandlerRejects(t *testing.T) {
+	d := newTestDaemon(t, Config{Staging: true}, newFakeGit(nil))
+	h := promoteHandler{daemons: []*daemon{d}, token: "secret"}
+
+	tests := []struct {
+		path  string
+		token string
+		code  int
+	}{
+		{"/promote?branch=master", "wrong", http.StatusUnauthorized},
+		{"/promote?branch=master", "secre", http.StatusUnauthorized},
+		{"/promote?branch=master", "", http.StatusUnauthorized},
+		{"/promote?branch=other", "secret", http.StatusNotFound},
+		{"/promote?branch=master&version=../../x", "secret", http.StatusBadRequest},
+		{"/promote?branch=master&version=.x", "secret", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, test.path, http.NoBody)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("%v with the token %q returned %v, want %v", test.path, test.token, rec.Code, test.code)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultStateFile holds the State of the repository configured with the
+// flags.
+const defaultStateFile = "state.json"
+
+// State is what the builder remembers across restarts.
+type State struct {
+	// Branches maps each branch to its state, the empty name denotes the
+	// checked out branch.
+	Branches map[string]*BranchState `json:"branches"`
+
+	// BuiltTags lists the tags which have been built.
+	BuiltTags []string `json:"built_tags,omitempty"`
+
+	// BuildTimes records when the builds of the last hour were started,
+	// for limiting the number of builds per hour.
+	BuildTimes []time.Time `json:"build_times,omitempty"`
+}
+
+// BranchState describes the last build of a branch.
+type BranchState struct {
+	// Commit is the commit built last, it is not built again.
+	Commit    string    `json:"commit"`
+	LastBuild time.Time `json:"last_build"`
+	LastError string    `json:"last_error,omitempty"`
+
+	// Failures counts the consecutive failed builds of each target, it is
+	// only tracked if quarantining targets is enabled. Quarantined records
+	// when the targets skipped because of their failures were quarantined.
+	Failures    map[string]int       `json:"failures,omitempty"`
+	Quarantined map[string]time.Time `json:"quarantined,omitempty"`
+}
+
+// loadState reads the state of repo from its state file. If it does not
+// exist yet, the files used by earlier versions are migrated for the
+// repository configured with the flags.
+func loadState(repo Repo) (*State, error) {
+	filename := repo.StateFile
+
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) && repo.Name == "" {
+		return migrateState(repo.Branches)
+	}
+
+	if os.IsNotExist(err) {
+		return &State{Branches: make(map[string]*BranchState)}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading state failed: %w", err)
+	}
+
+	var s State
+
+	err = json.Unmarshal(buf, &s)
+	if err != nil {
+		return nil, fmt.Errorf("parsing state file %v failed: %w", filename, err)
+	}
+
+	if s.Branches == nil {
+		s.Branches = make(map[string]*BranchState)
+	}
+
+	return &s, nil
+}
+
+// save atomically replaces filename with the state.
+func (s *State) save(filename string) error {
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAndRename(filename, append(buf, '\n'), 0600)
+}
+
+// commit returns the commit which was built last for branch.
+func (s *State) commit(branch string) string {
+	bs, ok := s.Branches[branch]
+	if !ok {
+		return ""
+	}
+
+	return bs.Commit
+}
+
+// setCommit records that commit has been handled for branch without building
+// it.
+func (s *State) setCommit(branch, commit string) {
+	bs, ok := s.Branches[branch]
+	if !ok {
+		bs = &BranchState{}
+		s.Branches[branch] = bs
+	}
+
+	bs.Commit = commit
+}
+
+// setBuilt records the result of building commit on branch.
+func (s *State) setBuilt(branch, commit string, err error) {
+	s.setCommit(branch, commit)
+
+	bs := s.Branches[branch]
+	bs.LastBuild = time.Now()
+	bs.LastError = ""
+
+	if err != nil {
+		bs.LastError = err.Error()
+	}
+}
+
+// tagBuilt returns true if tag has already been built.
+func (s *State) tagBuilt(tag string) bool {
+	for _, t := range s.BuiltTags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *State) addTag(tag string) {
+	if s.tagBuilt(tag) {
+		return
+	}
+
+	s.BuiltTags = append(s.BuiltTags, tag)
+	sort.Strings(s.BuiltTags)
+}
+
+// removeTag records that tag has to be built again.
+func (s *State) removeTag(tag string) {
+	tags := s.BuiltTags[:0]
+
+	for _, t := range s.BuiltTags {
+		if t != tag {
+			tags = append(tags, t)
+		}
+	}
+
+	s.BuiltTags = tags
+}
+
+// The files below were used for storing the state before state.json.
+const (
+	commitfile = "commit.current"
+	tagsfile   = "tags.built"
+)
+
+// commitfileFor returns the name of the file which stored the last built
+// commit for branch. The empty branch denotes the checked out branch.
+func commitfileFor(branch string) string {
+	if branch == "" {
+		return commitfile
+	}
+
+	return "commit." + strings.ReplaceAll(branch, "/", "_") + ".current"
+}
+
+// migrateState returns the state stored in the files of earlier versions for
+// branches. The files are left in place.
+func migrateState(branches []string) (*State, error) {
+	s := &State{Branches: make(map[string]*BranchState)}
+
+	if len(branches) == 0 {
+		branches = []string{""}
+	}
+
+	for _, branch := range branches {
+		commit, err := readCurrentCommit(commitfileFor(branch))
+		if err != nil {
+			return nil, err
+		}
+
+		if commit != "" {
+			slog.Info("migrating state", "file", commitfileFor(branch), "branch", branch, "commit", commit)
+			s.setCommit(branch, commit)
+		}
+	}
+
+	tags, err := readBuiltTags(tagsfile)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range tags {
+		s.addTag(tag)
+	}
+
+	return s, nil
+}
+
+func readCurrentCommit(commitfile string) (string, error) {
+	buf, err := ioutil.ReadFile(commitfile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("reading commit failed: %w", err)
+	}
+
+	return strings.TrimSpace(string(buf)), nil
+}
+
+func readBuiltTags(filename string) ([]string, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading built tags failed: %w", err)
+	}
+
+	return strings.Fields(string(buf)), nil
+}
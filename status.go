@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status records the outcome of the most recent builds, it is safe for
+// concurrent use.
+type Status struct {
+	mu       sync.Mutex
+	branches map[string]*branchStatus
+
+	lastPoll  time.Time
+	pollError string
+
+	// started is the time the daemon was started, for health checks
+	// before the first poll has finished.
+	started time.Time
+}
+
+// branchStatus is the status reported for a single branch.
+type branchStatus struct {
+	Repo        string    `json:"repo,omitempty"`
+	Branch      string    `json:"branch,omitempty"`
+	Commit      string    `json:"commit"`
+	Version     string    `json:"version"`
+	LastBuild   time.Time `json:"last_build"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	// FailingSince is the time of the first failed build after the last
+	// successful one, it is unset while the last build succeeded.
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+
+	// Pending is the newest commit of the branch which hasn't been built
+	// yet, PendingSince the time the first unbuilt commit was seen.
+	Pending      string     `json:"pending,omitempty"`
+	PendingSince *time.Time `json:"pending_since,omitempty"`
+
+	// Targets maps each target of the last build to "ok" or the error
+	// message.
+	Targets map[string]string `json:"targets"`
+
+	// Sizes compares the binaries of the last build to the previous
+	// version.
+	Sizes map[string]sizeChange `json:"sizes,omitempty"`
+
+	// History lists the durations of the recent builds, oldest first.
+	History []historyEntry `json:"history,omitempty"`
+
+	// Progress is set while the branch is being built.
+	Progress *buildProgress `json:"progress,omitempty"`
+}
+
+// The states of the targets in the progress of a build.
+const (
+	targetPending  = "pending"
+	targetBuilding = "building"
+	targetDone     = "done"
+	targetFailed   = "failed"
+)
+
+// buildProgress describes a running build.
+type buildProgress struct {
+	Version string    `json:"version"`
+	Started time.Time `json:"started"`
+
+	// Elapsed is the time since the build was started in seconds, it is
+	// filled in by snapshot.
+	Elapsed float64 `json:"elapsed"`
+
+	// Targets maps each target to its state.
+	Targets map[string]string `json:"targets"`
+}
+
+// progressTracker records the progress of a build of a branch in the status,
+// it is safe for concurrent use. The methods of a nil tracker do nothing, e.g.
+// when building once.
+type progressTracker struct {
+	status *Status
+	key    string
+}
+
+// startBuild records that version is being built for branch of repo, all of
+// targets are pending.
+func (s *Status) startBuild(repo, branch, version string, targets []BuildTarget) *progressTracker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := statusKey(repo, branch)
+
+	bs, ok := s.branches[key]
+	if !ok {
+		bs = &branchStatus{Repo: repo, Branch: branch}
+		s.branches[key] = bs
+	}
+
+	bs.Progress = &buildProgress{
+		Version: version,
+		Started: time.Now(),
+		Targets: make(map[string]string, len(targets)),
+	}
+
+	for _, target := range targets {
+		bs.Progress.Targets[target.String()] = targetPending
+	}
+
+	return &progressTracker{status: s, key: key}
+}
+
+// set records the state of target.
+func (t *progressTracker) set(target BuildTarget, state string) {
+	if t == nil {
+		return
+	}
+
+	t.status.mu.Lock()
+	defer t.status.mu.Unlock()
+
+	if p := t.status.branches[t.key].Progress; p != nil {
+		p.Targets[target.String()] = state
+	}
+}
+
+// finish removes the progress once the build is over.
+func (t *progressTracker) finish() {
+	if t == nil {
+		return
+	}
+
+	t.status.mu.Lock()
+	defer t.status.mu.Unlock()
+
+	t.status.branches[t.key].Progress = nil
+}
+
+func newStatus() *Status {
+	return &Status{
+		branches: make(map[string]*branchStatus),
+		started:  time.Now(),
+	}
+}
+
+// statusKey returns the key in Status.branches for branch of repo.
+func statusKey(repo, branch string) string {
+	return repo + "\x00" + branch
+}
+
+// restore fills in the branches of repo from the state saved by an earlier
+// run.
+func (s *Status) restore(repo string, state *State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for branch, bst := range state.Branches {
+		bs := &branchStatus{
+			Repo:      repo,
+			Branch:    branch,
+			Commit:    bst.Commit,
+			LastBuild: bst.LastBuild,
+			LastError: bst.LastError,
+		}
+
+		if bst.LastError == "" {
+			bs.LastSuccess = bst.LastBuild
+		} else {
+			// the state doesn't record older failures
+			since := bst.LastBuild
+			bs.FailingSince = &since
+		}
+
+		s.branches[statusKey(repo, branch)] = bs
+	}
+}
+
+// addHistory records entry for a build of repo, only the newest
+// statusHistory entries are kept for each branch.
+func (s *Status) addHistory(repo string, entry historyEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bs, ok := s.branches[statusKey(repo, entry.Branch)]
+	if !ok {
+		bs = &branchStatus{Repo: repo, Branch: entry.Branch}
+		s.branches[statusKey(repo, entry.Branch)] = bs
+	}
+
+	bs.History = lastEntries(append(bs.History, entry), statusHistory)
+}
+
+// polled records the end of a poll, err is the error returned by it. The time
+// of the last poll is only updated if it succeeded, so that a builder whose
+// polls keep failing becomes unhealthy.
+func (s *Status) polled(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pollError = ""
+
+	if err != nil {
+		s.pollError = err.Error()
+		return
+	}
+
+	s.lastPoll = time.Now()
+}
+
+// seen records that commit is the tip of branch of repo, built is false if it
+// hasn't been built or skipped yet.
+func (s *Status) seen(repo, branch, commit string, built bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bs, ok := s.branches[statusKey(repo, branch)]
+	if !ok {
+		bs = &branchStatus{Repo: repo, Branch: branch}
+		s.branches[statusKey(repo, branch)] = bs
+	}
+
+	if built {
+		bs.Pending, bs.PendingSince = "", nil
+		return
+	}
+
+	// a branch whose new commits are never built stays pending since the
+	// first one
+	bs.Pending = commit
+	if bs.PendingSince == nil {
+		now := time.Now()
+		bs.PendingSince = &now
+	}
+}
+
+// update records the result of a build of commit on branch of repo.
+func (s *Status) update(repo, branch, commit string, info buildInfo, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bs, ok := s.branches[statusKey(repo, branch)]
+	if !ok {
+		bs = &branchStatus{Repo: repo, Branch: branch}
+		s.branches[statusKey(repo, branch)] = bs
+	}
+
+	if bs.Pending == commit {
+		bs.Pending, bs.PendingSince = "", nil
+	}
+
+	bs.Commit = commit
+	bs.Version = info.Version
+	bs.LastBuild = time.Now()
+	bs.LastError = ""
+	bs.Targets = make(map[string]string)
+	bs.Sizes = info.Sizes
+
+	for _, target := range info.Built {
+		bs.Targets[target.String()] = "ok"
+	}
+
+	for target, err := range info.Failed {
+		bs.Targets[target] = err.Error()
+	}
+
+	if err != nil {
+		bs.LastError = err.Error()
+
+		if bs.FailingSince == nil {
+			since := bs.LastBuild
+			bs.FailingSince = &since
+		}
+	} else {
+		bs.LastSuccess = bs.LastBuild
+		bs.FailingSince = nil
+	}
+}
+
+// snapshot returns a copy of the status of all branches, sorted by
+// repository and branch.
+func (s *Status) snapshot() []branchStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]branchStatus, 0, len(s.branches))
+	for _, bs := range s.branches {
+		cp := *bs
+		cp.History = append([]historyEntry(nil), bs.History...)
+
+		if bs.Progress != nil {
+			p := *bs.Progress
+			p.Elapsed = time.Since(p.Started).Seconds()
+			p.Targets = make(map[string]string, len(bs.Progress.Targets))
+
+			for target, state := range bs.Progress.Targets {
+				p.Targets[target] = state
+			}
+
+			cp.Progress = &p
+		}
+		list = append(list, cp)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Repo != list[j].Repo {
+			return list[i].Repo < list[j].Repo
+		}
+
+		return list[i].Branch < list[j].Branch
+	})
+
+	return list
+}
+
+// heartbeat is written to the status file after each poll, monitoring can
+// alert if LastPoll gets too old.
+type heartbeat struct {
+	LastPoll  time.Time      `json:"last_poll"`
+	PollError string         `json:"poll_error,omitempty"`
+	Branches  []branchStatus `json:"branches"`
+}
+
+// writeFile atomically replaces filename with the current heartbeat.
+func (s *Status) writeFile(filename string) error {
+	s.mu.Lock()
+	hb := heartbeat{
+		LastPoll:  s.lastPoll,
+		PollError: s.pollError,
+	}
+	s.mu.Unlock()
+
+	hb.Branches = s.snapshot()
+
+	buf, err := json.MarshalIndent(hb, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAndRename(filename, append(buf, '\n'), 0644)
+}
+
+func (s *Status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	err := enc.Encode(s.snapshot())
+	if err != nil {
+		slog.Debug("writing status failed", "err", err)
+	}
+}
+
+// serveHTTP runs an HTTP server on addr serving handler until ctx is
+// canceled.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("serving HTTP", "addr", addr)
+
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// authorized reports whether r carries token as its bearer token. The
+// comparison takes constant time, so that the token can't be guessed from the
+// duration of rejected requests.
+func authorized(r *http.Request, token string) bool {
+	got := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) == 1
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// tagBranch is the name under which tag builds are reported and recorded. It
+// is not a valid branch name, so it can't be confused with a branch.
+const tagBranch = ":tags"
+
+// tagDirname is the subdirectory of the output directory the tags are built
+// into. Promoting selects the tag builds by this name.
+const tagDirname = "rc"
+
+// fetchTags fetches all tags from the remote repository, including those
+// which are not reachable from a branch.
+func fetchTags(ctx context.Context, remote Remote, dir string) error {
+	args := append([]string{"fetch", remote.verbosityArg(), "--tags"}, remote.depthArgs()...)
+
+	err := runRemote(ctx, remote, dir, append(args, "origin")...)
+	if err != nil {
+		return UpdateError{Err: err}
+	}
+
+	return nil
+}
+
+// listTags returns the tags matching the glob pattern, oldest first.
+func listTags(ctx context.Context, dir, pattern string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "git", "tag", "--list", "--sort=creatordate", pattern)
+	cmd.Stderr = os.Stderr
+	cmd.Dir = dir
+
+	buf, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git tag returned error: %w", err)
+	}
+
+	return strings.Fields(string(buf)), nil
+}
+
+// currentBranch returns the name of the checked out branch.
+func currentBranch(ctx context.Context, dir string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "symbolic-ref", "--quiet", "--short", "HEAD")
+	cmd.Stderr = os.Stderr
+	cmd.Dir = dir
+
+	buf, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git symbolic-ref returned error: %w", err)
+	}
+
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// checkoutTemporarily checks out rev in dir, fetching it first if it is not
+// known yet. The returned function restores the previous checkout.
+func checkoutTemporarily(ctx context.Context, g Git, remote Remote, dir, rev string) (restore func(), err error) {
+	commit, err := g.RevParse(ctx, dir, rev)
+	if err != nil {
+		slog.Info("commit not found, fetching", "rev", rev)
+
+		err = g.Fetch(ctx, remote, dir)
+		if err != nil {
+			return nil, err
+		}
+
+		commit, err = g.RevParse(ctx, dir, rev)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// HEAD is either a branch or detached at a commit
+	previous, err := g.CurrentBranch(ctx, dir)
+	detached := err != nil
+	if detached {
+		previous, err = g.RevParse(ctx, dir, "HEAD")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = g.Checkout(ctx, dir, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		// the checkout is also restored after an interrupt
+		ctx := context.WithoutCancel(ctx)
+
+		var err error
+		if detached {
+			err = g.Checkout(ctx, dir, previous)
+		} else {
+			err = g.SwitchBranch(ctx, dir, previous)
+		}
+
+		if err != nil {
+			slog.Error("restoring previous checkout failed", "rev", previous, "err", err)
+		}
+	}, nil
+}
+
+// switchBranch checks out branch, unlike checkout HEAD is not detached.
+func switchBranch(ctx context.Context, dir, branch string) error {
+	cmd := exec.CommandContext(ctx, "git", "checkout", "--quiet", "--force", branch)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = dir
+
+	return cmd.Run()
+}
+
+// pollTags builds all tags matching cfg.TagPattern which have not been built
+// yet. The tag is used as the version.
+func (d *daemon) pollTags(ctx context.Context) error {
+	cfg := d.cfg
+
+	err := retry(ctx, remoteAttempts, func() error {
+		return d.git.FetchTags(ctx, d.repo.Remote, d.repo.Dir)
+	})
+	if err != nil {
+		d.logRemoteError("fetching tags failed", err)
+		return err
+	}
+
+	tags, err := d.git.ListTags(ctx, d.repo.Dir, cfg.TagPattern)
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+
+	for _, tag := range tags {
+		if d.state.tagBuilt(tag) {
+			continue
+		}
+
+		// the tag is the version, which is used in file names
+		_, err := checkVersion(tag)
+		if err != nil {
+			d.log.Warn("skipping tag", "tag", tag, "err", err)
+			d.state.addTag(tag)
+
+			continue
+		}
+
+		pending = append(pending, tag)
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if cfg.DryRun {
+		for _, tag := range pending {
+			d.state.addTag(tag)
+
+			commit, err := d.git.RevParse(ctx, d.repo.Dir, tag)
+			if err != nil {
+				return err
+			}
+
+			err = d.logPlan(tagBranch, tag, commit)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err = checkOutputDir(d.publishdirFor(tagBranch))
+	if err != nil {
+		d.log.Error("output directory not usable, skipping tags", "err", err)
+		return err
+	}
+
+	// without configured branches the checked out branch is pulled, so it
+	// must be restored after building the tags
+	if len(d.repo.Branches) == 0 {
+		branch, err := d.git.CurrentBranch(ctx, d.repo.Dir)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			err := d.git.SwitchBranch(context.WithoutCancel(ctx), d.repo.Dir, branch)
+			if err != nil {
+				d.log.Error("restoring checked out branch failed", "branch", branch, "err", err)
+			}
+		}()
+	}
+
+	for _, tag := range pending {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// the remaining tags are built by the next polls
+		if !d.buildAllowed("tag", tag) {
+			return nil
+		}
+
+		d.log.Info("new tag", "tag", tag)
+
+		err = d.git.Checkout(ctx, d.repo.Dir, tag)
+		if err != nil {
+			d.log.Error("checkout failed", "tag", tag, "err", err)
+			return err
+		}
+
+		commit, err := d.git.RevParse(ctx, d.repo.Dir, "HEAD")
+		if err != nil {
+			return err
+		}
+
+		tagCfg := cfg
+		tagCfg.Changes = d.changesSince(ctx, tag)
+		tagCfg.Progress = d.status.startBuild(d.repo.Name, tagBranch, tag, tagCfg.Targets)
+
+		d.state.addBuildTime(time.Now())
+
+		setState(stateBuilding)
+		info, buildErr := build(ctx, d.repo.Dir, d.publishdirFor(tagBranch), tag, d.backendFor(tagBranch), tagCfg)
+		setState(statePolling)
+		tagCfg.Progress.finish()
+
+		switch {
+		case ctx.Err() != nil:
+			d.log.Info("build interrupted", "tag", tag)
+			return buildErr
+		case errors.As(buildErr, new(DiskFullError)):
+			// the tag isn't recorded, so it is built once there is enough space
+			d.log.Warn("not enough disk space, skipping build", "tag", tag, "err", buildErr)
+			return buildErr
+		}
+
+		if buildErr != nil {
+			d.log.Error("build failed", "tag", tag, "stage", failureStage(buildErr), "err", buildErr)
+		}
+
+		d.status.update(d.repo.Name, tagBranch, commit, info, buildErr)
+		d.recordHistory(tagBranch, commit, info, buildErr)
+		recordBuild(buildErr)
+
+		// each tag is built once, so every failure is reported
+		d.notify(tagBranch, commit, info, buildErr, false)
+
+		if buildErr == nil && cfg.S3 == nil {
+			err = writeIndex(d.publishdirFor(tagBranch), cfg.Index)
+			if err != nil {
+				d.log.Error("writing index failed", "err", err)
+			}
+		}
+
+		// each tag is only built once, even if the build failed
+		d.state.addTag(tag)
+
+		err = d.saveState()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// maxChanges is the maximum number of commits listed in the changes since the
+// previous tag.
+const maxChanges = 100
+
+// changesSince returns the commits between the previous tag matching
+// d.cfg.TagPattern and tag, or nil if there is no previous tag, e.g. for the
+// first release or in shallow clones.
+func (d *daemon) changesSince(ctx context.Context, tag string) *Changes {
+	prev, err := d.git.PreviousTag(ctx, d.repo.Dir, tag, d.cfg.TagPattern)
+	if err != nil {
+		d.log.Debug("no previous tag found", "tag", tag, "err", err)
+		return nil
+	}
+
+	commits, more, err := d.git.Log(ctx, d.repo.Dir, prev, tag, maxChanges)
+	if err != nil {
+		d.log.Warn("listing the changes since the previous tag failed", "tag", tag, "previous", prev, "err", err)
+		return nil
+	}
+
+	d.log.Info("changes since the previous tag", "tag", tag, "previous", prev, "commits", len(commits))
+
+	return &Changes{Since: prev, Commits: commits, Truncated: more}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBuildJobs is the number of finished build requests which can still be
+// queried.
+const maxBuildJobs = 100
+
+// buildJob is a build requested via POST /build. It is run by the next poll,
+// so it never overlaps with a build started by the poll loop.
+type buildJob struct {
+	ID        int        `json:"id"`
+	State     string     `json:"state"`
+	Requested time.Time  `json:"requested"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Error     string     `json:"error,omitempty"`
+
+	done chan struct{}
+}
+
+// buildRequests serves POST /build, which wakes up the poll loop so that new
+// commits are built right away, and GET /build/<id>, which returns the state
+// of a request. With wait=true, the response is sent once the build has
+// finished. Branches whose commit hasn't changed are only rebuilt via POST
+// /rebuild, which requires its own token.
+type buildRequests struct {
+	token string
+	wake  chan<- struct{}
+
+	mu      sync.Mutex
+	nextID  int
+	jobs    map[int]*buildJob
+	pending []*buildJob
+	running []*buildJob
+}
+
+func newBuildRequests(token string, wake chan<- struct{}) *buildRequests {
+	return &buildRequests{
+		token:  token,
+		wake:   wake,
+		nextID: 1,
+		jobs:   make(map[int]*buildJob),
+	}
+}
+
+func (b *buildRequests) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, b.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/build/") {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/build/"))
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+
+		job, ok := b.lookup(n)
+		if !ok {
+			http.Error(w, "unknown id", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, job)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job := b.add()
+	slog.Info("build requested", "id", job.ID, "remote", r.RemoteAddr)
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+
+	if r.URL.Query().Get("wait") == "true" {
+		select {
+		case <-job.done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	job, _ = b.lookup(job.ID)
+
+	code := http.StatusAccepted
+	if job.State == "done" {
+		code = http.StatusOK
+	}
+
+	writeJSON(w, code, job)
+}
+
+// add queues a new request.
+func (b *buildRequests) add() buildJob {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	job := &buildJob{
+		ID:        b.nextID,
+		State:     "queued",
+		Requested: time.Now(),
+		done:      make(chan struct{}),
+	}
+
+	b.nextID++
+	b.jobs[job.ID] = job
+	b.pending = append(b.pending, job)
+
+	// old requests are forgotten
+	delete(b.jobs, job.ID-maxBuildJobs)
+
+	return *job
+}
+
+// lookup returns a copy of the request with id.
+func (b *buildRequests) lookup(id int) (buildJob, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	job, ok := b.jobs[id]
+	if !ok {
+		return buildJob{}, false
+	}
+
+	return *job, true
+}
+
+// start marks the queued requests as running, it is called before each poll.
+func (b *buildRequests) start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, job := range b.pending {
+		job.State = "running"
+	}
+
+	b.running, b.pending = b.pending, nil
+}
+
+// finish records the result of the poll for the running requests.
+func (b *buildRequests) finish(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, job := range b.running {
+		now := time.Now()
+		job.State = "done"
+		job.Finished = &now
+
+		if err != nil {
+			job.Error = err.Error()
+		}
+
+		close(job.done)
+	}
+
+	b.running = nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Debug("writing response failed", "err", err)
+	}
+}
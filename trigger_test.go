@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBuildRequests(t *testing.T) {
+	wake := make(chan struct{}, 1)
+	b := newBuildRequests("secret", wake)
+
+	request := func(method, path, token string) (int, buildJob) {
+		req := httptest.NewRequest(method, path, http.NoBody)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, req)
+
+		var job buildJob
+		if rec.Code < 300 {
+			err := json.Unmarshal(rec.Body.Bytes(), &job)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return rec.Code, job
+	}
+
+	for _, token := range []string{"wrong", "secre", ""} {
+		if code, _ := request(http.MethodPost, "/build", token); code != http.StatusUnauthorized {
+			t.Errorf("request with the token %q returned %v", token, code)
+		}
+	}
+
+	code, job := request(http.MethodPost, "/build?force=true", "secret")
+	if code != http.StatusAccepted || job.State != "queued" {
+		t.Fatalf("request returned %v, job %+v", code, job)
+	}
+
+	select {
+	case <-wake:
+	default:
+		t.Error("poll loop wasn't woken up")
+	}
+
+	b.start()
+	b.finish(nil)
+
+	code, job = request(http.MethodGet, "/build/1", "secret")
+	if code != http.StatusOK || job.State != "done" || job.Finished == nil {
+		t.Errorf("finished request returned %v, job %+v", code, job)
+	}
+
+	if code, _ := request(http.MethodGet, "/build/2", "secret"); code != http.StatusNotFound {
+		t.Errorf("unknown request returned %v", code)
+	}
+}
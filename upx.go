@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+)
+
+// upxBinary is the packer which compresses the executables in place, see
+// https://upx.github.io.
+const upxBinary = "upx"
+
+// upxTargets lists the targets whose executable format UPX can pack. macOS
+// binaries aren't listed because packed ones are rejected by current
+// versions of the system.
+var upxTargets = map[string]bool{
+	"linux/386":     true,
+	"linux/amd64":   true,
+	"linux/arm":     true,
+	"linux/arm64":   true,
+	"linux/mips":    true,
+	"linux/mipsle":  true,
+	"linux/ppc64le": true,
+	"windows/386":   true,
+	"windows/amd64": true,
+}
+
+// packBinary compresses the executable filename built for target with UPX.
+// Failures are only logged, the binary is then left as it is.
+func packBinary(ctx context.Context, target BuildTarget, filename string) {
+	if !upxTargets[target.OS+"/"+target.Arch] {
+		slog.Warn("UPX doesn't support the target, not packing the binary", "target", target)
+		return
+	}
+
+	before, err := os.Stat(filename)
+	if err != nil {
+		slog.Warn("packing binary failed", "target", target, "err", err)
+		return
+	}
+
+	// upx refuses to overwrite an existing output file
+	tmp := filename + ".upx"
+	_ = os.Remove(tmp)
+
+	cmd := exec.CommandContext(ctx, upxBinary, "--best", "--no-progress", "-q", "-o", tmp, filename)
+
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
+		slog.Warn("packing binary failed", "target", target, "err", fmt.Errorf("%w: %s", err, bytes.TrimSpace(out)))
+
+		return
+	}
+
+	after, err := os.Stat(filename)
+	if err != nil {
+		slog.Warn("packing binary failed", "target", target, "err", err)
+		return
+	}
+
+	slog.Info("packed binary", "target", target, "before", formatSize(before.Size()), "after", formatSize(after.Size()))
+}
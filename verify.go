@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// verifyArtifacts checks the artifacts listed in the manifest of the version
+// directory dir against their checksums. It returns the manifest and the names
+// of the files which are missing or were modified.
+func verifyArtifacts(dir string) (Manifest, []string, error) {
+	m, err := readManifest(dir)
+	if err != nil {
+		return m, nil, fmt.Errorf("reading manifest failed: %w", err)
+	}
+
+	var corrupt []string
+
+	for _, a := range m.Artifacts {
+		sum, err := sha256File(filepath.Join(dir, a.Filename))
+		if err != nil || sum != a.SHA256 {
+			corrupt = append(corrupt, a.Filename)
+		}
+	}
+
+	if m.Source != nil {
+		sum, err := sha256File(filepath.Join(dir, m.Source.Filename))
+		if err != nil || sum != m.Source.SHA256 {
+			corrupt = append(corrupt, m.Source.Filename)
+		}
+	}
+
+	return m, corrupt, nil
+}
+
+// verifyPublished checks the binaries of the latest version published for
+// each branch, see Config.VerifyPublished. A notification is sent for
+// corrupted files, and with cfg.RebuildCorrupt the next poll rebuilds the
+// affected branches and tags. Builds published to S3 aren't checked.
+func (d *daemon) verifyPublished() {
+	cfg := d.cfg
+	d.verified = true
+
+	if cfg.S3 != nil {
+		return
+	}
+
+	branches := d.repo.Branches
+	if len(branches) == 0 {
+		branches = []string{""}
+	}
+
+	if cfg.TagPattern != "" {
+		branches = append(branches, tagBranch)
+	}
+
+	total := 0
+
+	for _, branch := range branches {
+		outputdir := d.repo.outputdirFor(branch)
+
+		latest, err := readLatest(outputdir)
+		if err != nil || latest == "" {
+			continue
+		}
+
+		start := time.Now()
+
+		m, corrupt, err := verifyArtifacts(filepath.Join(outputdir, latest))
+		if errors.Is(err, os.ErrNotExist) {
+			// published before manifests were written
+			continue
+		}
+
+		if err != nil {
+			d.log.Warn("unable to verify published build", "branch", branch, "dir", latest, "err", err)
+			continue
+		}
+
+		total += len(corrupt)
+
+		if len(corrupt) == 0 {
+			d.log.Debug("verified published build", "branch", branch, "dir", latest, "duration", time.Since(start))
+			continue
+		}
+
+		d.log.Error("published binaries don't match their checksums", "branch", branch, "dir", latest, "files", corrupt)
+
+		if cfg.WebhookURL != "" {
+			payload := webhookPayload{
+				Status:    "corrupt",
+				Repo:      d.repo.Name,
+				Branch:    branch,
+				Commit:    m.Commit,
+				Version:   m.Version,
+				CommitURL: d.repo.Remote.forge().CommitURL(m.Commit),
+				Files:     corrupt,
+				Error:     fmt.Sprintf("%d published files don't match their checksums", len(corrupt)),
+			}
+
+			err := notifyWebhook(cfg.WebhookURL, cfg.WebhookType, payload)
+			if err != nil {
+				d.log.Error("webhook notification failed", "err", err)
+			}
+		}
+
+		if cfg.RebuildCorrupt {
+			d.log.Info("rebuilding corrupted build", "branch", branch, "version", m.Version)
+			d.rebuildCorrupt(branch, m.Version)
+		}
+	}
+
+	corruptFiles.WithLabelValues(d.repo.Name).Set(float64(total))
+}
+
+// rebuildCorrupt requests building branch again in the next poll, the other
+// branches are only built if their commit changed. Tags are built once, so
+// for a corrupted tag build the tag version is marked as not built instead.
+func (d *daemon) rebuildCorrupt(branch, version string) {
+	if branch == tagBranch && d.cfg.TagPattern != "" {
+		d.state.removeTag(version)
+		return
+	}
+
+	if d.rebuild == nil {
+		d.rebuild = make(map[string]bool)
+	}
+
+	d.rebuild[branch] = true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// VersionScheme derives the version of a build from the commit, which names
+// the version directory and usually the binaries. The zero value uses the
+// output of git describe.
+type VersionScheme struct {
+	// Template renders the version from versionData.
+	Template *template.Template
+
+	// Command is run in the repository and prints the version, instead
+	// of rendering Template. $BETA_COMMIT, $BETA_BRANCH and
+	// $BETA_DESCRIBE are set.
+	Command []string
+}
+
+// versionData is available in the version template.
+type versionData struct {
+	// Describe is the output of "git describe --long --tags --dirty
+	// --always", the default version.
+	Describe string
+
+	Commit      string
+	ShortCommit string
+
+	// Tag is the newest tag reachable from the commit, it is empty if
+	// there is none.
+	Tag string
+
+	// Date is the commit date and Branch the built branch, which is empty
+	// for the checked out one.
+	Date   time.Time
+	Branch string
+}
+
+// parseVersionTemplate parses the template for the versions.
+func parseVersionTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("version").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// catch typos in field names before the first build
+	_, err = renderVersion(tmpl, versionData{
+		Describe:    "v0.0.0-0-g0000000",
+		Commit:      strings.Repeat("0", 40),
+		ShortCommit: "0000000",
+		Tag:         "v0.0.0",
+		Date:        time.Now(),
+		Branch:      "master",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// validVersion matches versions which can be used in file names and URLs.
+var validVersion = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._+~-]*$`)
+
+func renderVersion(tmpl *template.Template, data versionData) (string, error) {
+	var buf bytes.Buffer
+
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("render version failed: %w", err)
+	}
+
+	return checkVersion(buf.String())
+}
+
+// checkVersion returns version if it is safe to use in file names.
+func checkVersion(version string) (string, error) {
+	if !validVersion.MatchString(version) {
+		return "", fmt.Errorf("version %q is not usable as a file name, only letters, digits and ._+~- are allowed", version)
+	}
+
+	return version, nil
+}
+
+// deriveVersion returns the version of commit of branch in dir according to
+// scheme, the empty commit denotes the working tree.
+func deriveVersion(ctx context.Context, g Git, scheme VersionScheme, dir, branch, commit string) (string, error) {
+	describe, err := g.Describe(ctx, dir, commit)
+	if err != nil {
+		return "", err
+	}
+
+	if len(scheme.Command) == 0 && scheme.Template == nil {
+		return checkVersion(describe)
+	}
+
+	rev := commit
+	if rev == "" {
+		rev = "HEAD"
+	}
+
+	id, err := g.RevParse(ctx, dir, rev)
+	if err != nil {
+		return "", err
+	}
+
+	if len(scheme.Command) > 0 {
+		return runVersionCommand(ctx, scheme.Command, dir, branch, id, describe)
+	}
+
+	data := versionData{
+		Describe: describe,
+		Commit:   id,
+		Branch:   branch,
+	}
+
+	if len(id) >= 7 {
+		data.ShortCommit = id[:7]
+	}
+
+	// the tag is empty if there is none
+	data.Tag, _ = g.LatestTag(ctx, dir, id)
+
+	data.Date, err = g.CommitDate(ctx, dir, id)
+	if err != nil {
+		return "", err
+	}
+
+	return renderVersion(scheme.Template, data)
+}
+
+// runVersionCommand runs args in dir and returns the version it printed.
+func runVersionCommand(ctx context.Context, args []string, dir, branch, commit, describe string) (string, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"BETA_COMMIT="+commit,
+		"BETA_BRANCH="+branch,
+		"BETA_DESCRIBE="+describe,
+	)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("version command failed: %w", err)
+	}
+
+	return checkVersion(strings.TrimSpace(string(out)))
+}
+
+// latestTag returns the newest tag reachable from commit, it fails if there is
+// none.
+func latestTag(ctx context.Context, dir, commit string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "describe", "--tags", "--abbrev=0", commit)
+	cmd.Dir = dir
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git describe returned error: %w", err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// commitDate returns the committer date of commit.
+func commitDate(ctx context.Context, dir, commit string) (time.Time, error) {
+	cmd := exec.CommandContext(ctx, "git", "show", "--no-patch", "--format=%cI", commit)
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("git show returned error: %w", err)
+	}
+
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(out)))
+}
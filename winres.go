@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// goversioninfo is the tool which compiles the version information and the
+// icon into a resource file, see github.com/josephspurrier/goversioninfo.
+const goversioninfo = "goversioninfo"
+
+// WindowsResources describes the version information and the icon embedded
+// into the binaries for Windows.
+type WindowsResources struct {
+	// Icon is the absolute path of the .ico file, empty embeds no icon.
+	Icon string
+
+	Description string
+	Company     string
+	Copyright   string
+}
+
+// fileVersion is the numeric version of a Windows binary.
+type fileVersion struct {
+	Major int
+	Minor int
+	Patch int
+	Build int
+}
+
+// describeVersion matches the versions returned by git describe, the number
+// of commits since the tag becomes the build number.
+var describeVersion = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(?:.*-(\d+)-g[0-9a-f]+)?`)
+
+// parseFileVersion returns the numeric version for version, which is zero if
+// it isn't derived from a tag.
+func parseFileVersion(version string) fileVersion {
+	m := describeVersion.FindStringSubmatch(version)
+	if m == nil {
+		return fileVersion{}
+	}
+
+	var n [4]int
+	for i, s := range m[1:] {
+		n[i], _ = strconv.Atoi(s)
+	}
+
+	return fileVersion{Major: n[0], Minor: n[1], Patch: n[2], Build: n[3]}
+}
+
+// versionInfo is the configuration file read by goversioninfo.
+type versionInfo struct {
+	FixedFileInfo struct {
+		FileVersion    fileVersion
+		ProductVersion fileVersion
+		FileFlagsMask  string
+		FileFlags      string
+		FileOS         string
+		FileType       string
+		FileSubType    string
+	}
+	StringFileInfo map[string]string
+	VarFileInfo    struct {
+		Translation struct {
+			LangID    string
+			CharsetID string
+		}
+	}
+	IconPath string
+}
+
+func newVersionInfo(res WindowsResources, version, filename string) versionInfo {
+	var vi versionInfo
+
+	v := parseFileVersion(version)
+	vi.FixedFileInfo.FileVersion = v
+	vi.FixedFileInfo.ProductVersion = v
+	vi.FixedFileInfo.FileFlagsMask = "3f"
+	vi.FixedFileInfo.FileFlags = "00"
+	vi.FixedFileInfo.FileOS = "040004"
+	vi.FixedFileInfo.FileType = "01"
+	vi.FixedFileInfo.FileSubType = "00"
+
+	vi.StringFileInfo = map[string]string{
+		"ProductName":      "restic",
+		"InternalName":     "restic",
+		"ProductVersion":   version,
+		"FileVersion":      version,
+		"FileDescription":  res.Description,
+		"CompanyName":      res.Company,
+		"LegalCopyright":   res.Copyright,
+		"OriginalFilename": filename,
+	}
+
+	vi.VarFileInfo.Translation.LangID = "0409"
+	vi.VarFileInfo.Translation.CharsetID = "04B0"
+	vi.IconPath = res.Icon
+
+	return vi
+}
+
+// resourceArchFlags maps the architectures supported by goversioninfo to its
+// flags.
+var resourceArchFlags = map[string][]string{
+	"386":   nil,
+	"amd64": {"-64"},
+	"arm":   {"-arm"},
+	"arm64": {"-arm", "-64"},
+}
+
+// writeWindowsResources creates the resource files for the Windows targets in
+// the main package pkg of the repository in repodir, which the go command links
+// into the binaries for the matching architecture. The returned function
+// removes them again. If goversioninfo is not installed, nothing is done.
+func writeWindowsResources(ctx context.Context, repodir, pkg string, res WindowsResources, version string, targets []BuildTarget, filenames map[string]string) (func(), error) {
+	var files []string
+
+	cleanup := func() {
+		for _, file := range files {
+			_ = os.Remove(file)
+		}
+	}
+
+	_, err := exec.LookPath(goversioninfo)
+	if err != nil {
+		slog.Warn("goversioninfo not found, building Windows binaries without version information", "err", err)
+		return func() {}, nil
+	}
+
+	// goversioninfo runs in the temporary directory
+	pkgdir, err := filepath.Abs(filepath.Join(repodir, filepath.FromSlash(pkg)))
+	if err != nil {
+		return func() {}, err
+	}
+
+	tempdir, err := ioutil.TempDir("", "beta-winres-")
+	if err != nil {
+		return func() {}, err
+	}
+
+	defer os.RemoveAll(tempdir)
+	done := make(map[string]bool)
+
+	for _, target := range targets {
+		if target.OS != "windows" || done[target.Arch] {
+			continue
+		}
+
+		done[target.Arch] = true
+
+		flags, ok := resourceArchFlags[target.Arch]
+		if !ok {
+			slog.Warn("embedding resources is not supported for the architecture", "target", target)
+			continue
+		}
+
+		buf, err := json.Marshal(newVersionInfo(res, version, filenames[target.String()]))
+		if err != nil {
+			cleanup()
+			return func() {}, err
+		}
+
+		config := filepath.Join(tempdir, "versioninfo_"+target.Arch+".json")
+
+		err = ioutil.WriteFile(config, buf, 0644)
+		if err != nil {
+			cleanup()
+			return func() {}, err
+		}
+
+		// the suffix restricts the file to the target, like for .go files
+		file := filepath.Join(pkgdir, "zz_beta_windows_"+target.Arch+".syso")
+
+		files = append(files, file)
+
+		args := append([]string{"-o", file}, flags...)
+		cmd := exec.CommandContext(ctx, goversioninfo, append(args, config)...)
+		cmd.Dir = tempdir
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			cleanup()
+			return func() {}, fmt.Errorf("creating Windows resources for %v failed: %w\n%s", target.Arch, err, out)
+		}
+	}
+
+	slog.Debug("created Windows resources", "version", version, "files", len(files))
+
+	return cleanup, nil
+}